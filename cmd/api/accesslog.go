@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"greenlight.mpdev.com/internal/accesslog"
+	"greenlight.mpdev.com/internal/ratelimit"
+)
+
+// Define an accessLogRule struct to set the fraction of requests to matching routes
+// which are written to the access log. Route is a pattern as for rate limit policies.
+type accessLogRule struct {
+	route string
+	rate  float64
+}
+
+// The parseAccessLogRules() helper parses the -access-log-exclude and
+// -access-log-sample flags. Excluded routes come first, with a rate of 0.
+func parseAccessLogRules(exclude, sample string) ([]accessLogRule, error) {
+	var rules []accessLogRule
+
+	for _, route := range strings.Fields(exclude) {
+		rules = append(rules, accessLogRule{route: route})
+	}
+
+	for _, field := range strings.Fields(sample) {
+		route, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("access log sample %q must be in the form route=rate", field)
+		}
+
+		rate, err := strconv.ParseFloat(val, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("access log sample rate for %s must be between 0 and 1", route)
+		}
+
+		rules = append(rules, accessLogRule{route: route, rate: rate})
+	}
+
+	return rules, nil
+}
+
+// The logAccess() helper writes the request to the access log, using the response
+// metrics captured by the metrics() middleware. Requests are logged unless the first
+// rule matching the path says otherwise, but server errors on sampled routes are
+// always logged.
+func (app *application) logAccess(r *http.Request, start time.Time, info *requestInfo, m httpsnoop.Metrics) {
+	if app.accessLog == nil {
+		return
+	}
+
+	for _, rule := range app.config.accessLog.rules {
+		if ratelimit.MatchRoute(rule.route, r.URL.Path) {
+			if rule.rate == 0 || (m.Code < 500 && rand.Float64() >= rule.rate) {
+				return
+			}
+			break
+		}
+	}
+
+	err := app.accessLog.Log(accesslog.Entry{
+		Time:      start,
+		RequestID: app.contextGetRequestID(r),
+		IP:        app.contextGetClientIP(r),
+		UserID:    info.userID,
+		Method:    r.Method,
+		URI:       r.URL.RequestURI(),
+		Proto:     r.Proto,
+		Status:    m.Code,
+		Bytes:     m.Written,
+		Duration:  m.Duration,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	})
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "writing access log", "error", err.Error())
+	}
+}
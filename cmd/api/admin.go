@@ -0,0 +1,408 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"greenlight.mpdev.com/internal/data"
+	"greenlight.mpdev.com/internal/validator"
+)
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name  string
+		Email string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Name = app.readString(qs, "name", "")
+	input.Email = app.readString(qs, "email", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(r.Context(), input.Name, input.Email, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeUserAccess(w, r, user)
+}
+
+// Activate or deactivate a user account. Deactivating an account also signs the user
+// out, since requireActivatedUser is only checked on routes that need it.
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Activated *bool `json:"activated"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Activated != nil, "activated", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.Activated = *input.Activated
+
+	err = app.models.Transaction(r.Context(), func(tx data.Models) error {
+		err := tx.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		action := data.AuditUserActivated
+
+		if !user.Activated {
+			action = data.AuditUserDeactivated
+
+			err = tx.Tokens.DeleteAllScopesForUser(r.Context(), user.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return app.audit(r, tx, action, user.ID, nil)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) grantPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changePermissions(w, r, true)
+}
+
+func (app *application) revokePermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changePermissions(w, r, false)
+}
+
+// The changePermissions() helper implements both granting and revoking permissions,
+// which only differ in the model method they call and the audited action.
+func (app *application) changePermissions(w http.ResponseWriter, r *http.Request, grant bool) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	known, err := app.models.Permissions.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidatePermissionCodes(v, input.Permissions, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Transaction(r.Context(), func(tx data.Models) error {
+		action := data.AuditPermissionsGranted
+
+		if grant {
+			err = tx.Permissions.AddForUser(r.Context(), user.ID, input.Permissions...)
+		} else {
+			action = data.AuditPermissionsRevoked
+			err = tx.Permissions.RemoveForUser(r.Context(), user.ID, input.Permissions...)
+		}
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, action, user.ID, map[string]any{"permissions": input.Permissions})
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.permissions.Invalidate(user.ID)
+
+	app.writeUserAccess(w, r, user)
+}
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) assignRolesHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeRoles(w, r, true)
+}
+
+func (app *application) removeRolesHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeRoles(w, r, false)
+}
+
+// The changeRoles() helper implements both assigning and removing roles.
+func (app *application) changeRoles(w http.ResponseWriter, r *http.Request, assign bool) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Roles []string `json:"roles"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	known, err := app.models.Roles.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateRoleNames(v, input.Roles, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Transaction(r.Context(), func(tx data.Models) error {
+		action := data.AuditRolesAssigned
+
+		if assign {
+			err = tx.Roles.AddForUser(r.Context(), user.ID, input.Roles...)
+		} else {
+			action = data.AuditRolesRemoved
+			err = tx.Roles.RemoveForUser(r.Context(), user.ID, input.Roles...)
+		}
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, action, user.ID, map[string]any{"roles": input.Roles})
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.permissions.Invalidate(user.ID)
+
+	app.writeUserAccess(w, r, user)
+}
+
+// The writeUserAccess() helper responds with the user along with their roles and
+// effective permissions, i.e. both those granted directly and through roles.
+func (app *application) writeUserAccess(w http.ResponseWriter, r *http.Request, user *data.User) {
+	roles, err := app.models.Roles.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "roles": roles, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Force a logout by revoking all of a user's tokens, including OAuth access tokens.
+func (app *application) logoutUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Transaction(r.Context(), func(tx data.Models) error {
+		err := tx.Tokens.DeleteAllScopesForUser(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, data.AuditUserLoggedOut, user.ID, nil)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "the user has been logged out of all sessions"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Clear the failed login counter and any lockout for a user.
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Transaction(r.Context(), func(tx data.Models) error {
+		err := tx.LoginAttempts.Reset(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, data.AuditUserUnlocked, user.ID, nil)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "the user account has been unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Action string
+		UserID int
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Action = app.readString(qs, "action", "")
+	input.UserID = app.readInt(qs, "user_id", 0, v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{"id", "created_at", "action", "-id", "-created_at", "-action"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, metadata, err := app.models.Audit.GetAll(r.Context(), input.Action, int64(input.UserID), input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"audit_log": entries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readUserParam() helper looks up the user identified by the "id" URL parameter.
+// If the user doesn't exist it sends a 404 Not Found response and returns false.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// The audit() helper records an administrative action performed by the current user.
+// Pass a targetUserID of 0 for actions which aren't performed on a particular user, and
+// the models of the transaction which applies the action, so that the action and its
+// entry are committed together or not at all.
+func (app *application) audit(r *http.Request, models data.Models, action string, targetUserID int64, details map[string]any) error {
+	actor := app.contextGetUser(r)
+
+	entry := &data.AuditEntry{
+		ActorID: &actor.ID,
+		Action:  action,
+		Details: details,
+		IP:      app.contextGetClientIP(r),
+	}
+
+	if targetUserID != 0 {
+		entry.TargetUserID = &targetUserID
+	}
+
+	return models.Audit.Insert(r.Context(), entry)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// The clientIP() helper works out the IP address of the client which made the request.
+// When the connection comes from one of the -trusted-proxies, we walk the proxy chain
+// in the configured forwarding header from right to left, skipping our own proxies,
+// and take the first address we don't trust. Everything to the left of that address
+// was supplied by the client and could be forged, so it is never used. If a trusted
+// proxy passed on something which isn't an IP address, such as "unknown", we stop at
+// that proxy.
+func (app *application) clientIP(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", err
+	}
+	addr = addr.Unmap()
+
+	if !app.trustedProxy(addr) {
+		return addr.String(), nil
+	}
+
+	var hops []string
+
+	switch app.config.proxies.header {
+	case "Forwarded":
+		hops = parseForwarded(r.Header.Values("Forwarded"))
+	default:
+		hops = parseForwardedFor(r.Header.Values(app.config.proxies.header))
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseHop(hops[i])
+		if err != nil {
+			break
+		}
+
+		addr = hop
+
+		if !app.trustedProxy(addr) {
+			break
+		}
+	}
+
+	return addr.String(), nil
+}
+
+func (app *application) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range app.config.proxies.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// The parseForwardedFor() helper returns the addresses in X-Forwarded-For style headers,
+// which are comma separated lists of addresses. Values from repeated headers are
+// joined in order.
+func parseForwardedFor(values []string) []string {
+	var hops []string
+
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	return hops
+}
+
+// The parseForwarded() helper returns the "for" parameter of each element of RFC 7239
+// Forwarded headers, such as `for=192.0.2.60;proto=https, for="[2001:db8::1]:4711"`.
+// Elements without a "for" parameter are returned as empty strings, so that they
+// still count as a hop.
+func parseForwarded(values []string) []string {
+	var hops []string
+
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hop = val
+				}
+			}
+
+			hops = append(hops, hop)
+		}
+	}
+
+	return hops
+}
+
+// The parseHop() helper parses a node from a forwarding header. It may be quoted, may
+// have a port, and IPv6 addresses may be in brackets.
+func parseHop(hop string) (netip.Addr, error) {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return addr.Unmap(), nil
+}
+
+// The parseTrustedProxies() helper parses a space separated list of CIDR ranges and IP
+// addresses for the -trusted-proxies flag.
+func parseTrustedProxies(val string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, field := range strings.Fields(val) {
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
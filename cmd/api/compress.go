@@ -0,0 +1,360 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/felixge/httpsnoop"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is implemented by the gzip, brotli and zstd writers.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+	Flush() error
+}
+
+// The encodings we support, in the order we prefer them when the client accepts more
+// than one equally.
+var encodings = []string{"br", "zstd", "gzip"}
+
+// Pools of encoders for each encoding, since they are expensive to create and keep
+// sizable buffers.
+var encoderPools = map[string]*sync.Pool{
+	"br": {New: func() any {
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	"zstd": {New: func() any {
+		// Browsers only support windows up to 8MB when zstd is used as a content
+		// encoding (RFC 8878). The options are all valid, so the error is always nil.
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20))
+		return enc
+	}},
+	"gzip": {New: func() any {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+// Media types which are already compressed, so compressing them again only wastes CPU.
+// Entries ending in '/' match the whole type.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"font/woff2",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/pdf",
+}
+
+// The negotiateEncoding() helper picks an encoding from an Accept-Encoding header, as
+// described in RFC 9110 section 12.5.3. It returns an empty string if the response
+// should not be compressed.
+func negotiateEncoding(header string) string {
+	if header == "" {
+		return ""
+	}
+
+	weights := make(map[string]float64)
+
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+
+		q := 1.0
+
+		for _, param := range strings.Split(params, ";") {
+			key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(key, "q") {
+				parsed, err := strconv.ParseFloat(val, 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		weights[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, encoding := range encodings {
+		q, ok := weights[encoding]
+		if !ok {
+			q, ok = weights["*"]
+		}
+
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+// The compressible() helper reports whether a response with the given Content-Type
+// header is worth compressing.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+
+	for _, t := range incompressibleTypes {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Define a compressWriter type to compress a response on its way to the client. It
+// holds back the status code and the start of the body until it has seen enough to
+// decide whether compression is worthwhile: responses smaller than minSize, responses
+// which are already encoded and incompressible media types are passed through as is.
+type compressWriter struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	encoding string
+	minSize  int
+
+	status    int
+	buf       []byte
+	decided   bool
+	streaming bool
+	enc       encoder
+}
+
+func (cw *compressWriter) writeHeader(code int) {
+	if cw.status != 0 || cw.decided {
+		return
+	}
+
+	// Informational responses, like 103 Early Hints, go straight out.
+	if code >= 100 && code <= 199 {
+		cw.w.WriteHeader(code)
+		return
+	}
+
+	cw.status = code
+}
+
+func (cw *compressWriter) write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.writeHeader(http.StatusOK)
+	}
+
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(b)
+		}
+		return cw.w.Write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+
+	if len(cw.buf) >= cw.minSize {
+		err := cw.decide()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// The flush() method sends what has been written so far. A handler which flushes is
+// streaming its response, so we don't know how large it will be and compress it
+// regardless of minSize. Flushing before anything has been written sends a 200 status,
+// as it would without compression.
+func (cw *compressWriter) flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+
+		cw.streaming = true
+		cw.decide()
+	}
+
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+
+	if flusher, ok := cw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// The decide() method chooses whether to compress the response, then sends the headers
+// and whatever part of the body has been held back.
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+
+	h := cw.w.Header()
+
+	// The client would see the Content-Type sniffed from the compressed bytes if we
+	// left it to net/http, so sniff it here from the original ones.
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	// An empty body stays empty, rather than becoming an empty compressed stream, even
+	// with a minSize of 0.
+	compress := ((len(cw.buf) >= cw.minSize && len(cw.buf) > 0) || cw.streaming) &&
+		cw.r.Method != http.MethodHead &&
+		cw.status != http.StatusNoContent &&
+		cw.status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" &&
+		compressible(h.Get("Content-Type"))
+
+	if compress {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+
+		// The compressed body is no longer byte-for-byte the one a strong ETag
+		// promises, but it is semantically equivalent, so weaken the ETag. Weak ETags
+		// still work with If-None-Match.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+
+		cw.enc = encoderPools[cw.encoding].Get().(encoder)
+		cw.enc.Reset(cw.w)
+	}
+
+	cw.w.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.w.Write(buf)
+	}
+
+	return err
+}
+
+// The close() method sends anything still held back and finishes the compressed
+// stream.
+func (cw *compressWriter) close() error {
+	if cw.status != 0 && !cw.decided {
+		err := cw.decide()
+		if err != nil {
+			return err
+		}
+	}
+
+	if cw.enc == nil {
+		return nil
+	}
+
+	err := cw.enc.Close()
+	cw.release()
+
+	return err
+}
+
+// The release() method returns the encoder, if any, to its pool.
+func (cw *compressWriter) release() {
+	if cw.enc != nil {
+		encoderPools[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+// The compress() middleware compresses responses with the best encoding the client
+// accepts. It wraps the ResponseWriter with httpsnoop, like the metrics() middleware
+// does, so that optional interfaces such as http.Flusher keep working, and so that
+// metrics() sees the number of compressed bytes actually sent.
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.compression.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Whether or not we compress this response, another client could get a
+		// different encoding for the same URL.
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			w:        w,
+			r:        r,
+			encoding: encoding,
+			minSize:  app.config.compression.minSize,
+		}
+
+		wrapped := httpsnoop.Wrap(w, httpsnoop.Hooks{
+			WriteHeader: func(httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return cw.writeHeader
+			},
+			Write: func(httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return cw.write
+			},
+			Flush: func(httpsnoop.FlushFunc) httpsnoop.FlushFunc {
+				return cw.flush
+			},
+			ReadFrom: func(httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+				return func(src io.Reader) (int64, error) {
+					return io.Copy(writerFunc(cw.write), src)
+				}
+			},
+		})
+
+		// If the handler panics, recoverPanic() sends a 500 response on the writer we
+		// were given, so we mustn't send what we held back; but the encoder still has
+		// to go back to its pool.
+		defer cw.release()
+
+		next.ServeHTTP(wrapped, r)
+
+		err := cw.close()
+		if err != nil {
+			app.logError(r, err)
+		}
+	})
+}
+
+// writerFunc adapts a function to io.Writer.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
@@ -10,9 +10,28 @@ import (
 // Define a custom contextKey type, with the underlying type string.
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey        = contextKey("user")
+	permissionsContextKey = contextKey("permissions")
+	tokenScopesContextKey = contextKey("token_scopes")
+	delegationContextKey  = contextKey("delegation")
+	clientIPContextKey    = contextKey("client_ip")
+	requestIDContextKey   = contextKey("request_id")
+	requestInfoContextKey = contextKey("request_info")
+)
+
+// Define a requestInfo struct to collect details about a request while it is handled,
+// for outer middleware like metrics(), which can't see the context values that inner
+// middleware and handlers add to their copies of the request.
+type requestInfo struct {
+	userID int64
+	route  string
+}
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo); ok {
+		info.userID = user.ID
+	}
 
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
@@ -25,3 +44,74 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// The contextSetPermissions() method stores the current user's permissions once they
+// have been loaded, so that later checks in the same request don't load them again.
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
+
+// The contextSetTokenScopes() method records the scopes granted to a third-party client
+// when the request was authenticated with an OAuth access token.
+func (app *application) contextSetTokenScopes(r *http.Request, scopes []string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenScopesContextKey, scopes)
+	return r.WithContext(ctx)
+}
+
+// The contextGetTokenScopes() method returns the granted scopes, and false if the request
+// wasn't made with an OAuth access token.
+func (app *application) contextGetTokenScopes(r *http.Request) ([]string, bool) {
+	scopes, ok := r.Context().Value(tokenScopesContextKey).([]string)
+	return scopes, ok
+}
+
+// The contextSetDelegationAllowed() method marks the route as one which third-party
+// clients may use. See requirePermission().
+func (app *application) contextSetDelegationAllowed(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), delegationContextKey, true)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetDelegationAllowed(r *http.Request) bool {
+	allowed, _ := r.Context().Value(delegationContextKey).(bool)
+	return allowed
+}
+
+// The contextSetClientIP() method stores the client's IP address, as resolved by the
+// realIP() middleware.
+func (app *application) contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+	return r.WithContext(ctx)
+}
+
+// The contextGetClientIP() method returns the client's IP address, or an empty string
+// if the request hasn't been through the realIP() middleware.
+func (app *application) contextGetClientIP(r *http.Request) string {
+	ip, _ := r.Context().Value(clientIPContextKey).(string)
+	return ip
+}
+
+// The contextSetRequestID() method stores the ID assigned to the request by the
+// requestID() middleware.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// The contextSetRequestInfo() method stores the requestInfo which the rest of the chain
+// fills in. See requestInfo.
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoContextKey, info)
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// corsExposedHeaders lists the response headers, beyond the CORS-safelisted ones, which
+// browsers should let cross-origin scripts read.
+var corsExposedHeaders = []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Request-ID", "Idempotency-Replayed"}
+
+// The corsOrigin() helper checks the origin against -cors-trusted-origins. It returns
+// whether the origin is allowed, and whether credentialed requests are allowed from it.
+// An entry may be an exact origin like "https://www.example.com", a wildcard like
+// "https://*.example.com" which matches any subdomain (but not example.com itself), or
+// "*" to allow every origin. Credentials are only allowed for origins which are listed
+// exactly, so that a wildcard can't expose users' data to every subdomain.
+func (app *application) corsOrigin(origin string) (allowed, credentials bool) {
+	for _, trusted := range app.config.cors.trustedOrigins {
+		switch {
+		case trusted == "*":
+			allowed = true
+		case strings.EqualFold(origin, trusted):
+			return true, true
+		case matchWildcardOrigin(trusted, origin):
+			allowed = true
+		}
+	}
+
+	return allowed, false
+}
+
+// The matchWildcardOrigin() helper reports whether origin matches a pattern like
+// "https://*.example.com", where the '*' stands for one or more subdomain labels.
+func matchWildcardOrigin(pattern, origin string) bool {
+	prefix, suffix, ok := strings.Cut(strings.ToLower(pattern), "*")
+	if !ok {
+		return false
+	}
+
+	origin = strings.ToLower(origin)
+
+	if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+
+	subdomain := origin[len(prefix) : len(origin)-len(suffix)]
+
+	return !strings.ContainsAny(subdomain, "/:@?#") && !strings.HasPrefix(subdomain, ".")
+}
+
+// The validTrustedOrigin() helper checks an entry in -cors-trusted-origins. Apart from
+// "*", entries must be a scheme and host with no path, and a wildcard may only be used
+// as the first label of the host.
+func validTrustedOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+
+	return u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil && !strings.Contains(u.Host, "*")
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // The logError() method is a generic helper for logging an error message along
@@ -11,22 +14,28 @@ func (app *application) logError(r *http.Request, err error) {
 	var (
 		method = r.Method
 		uri    = r.URL.RequestURI()
+		ip     = app.contextGetClientIP(r)
 	)
 
-	app.logger.Printf(err.Error(), "method", method, "uri", uri)
+	app.logger.ErrorContext(r.Context(), err.Error(), "method", method, "uri", uri, "ip", ip)
 }
 
 // The errorResponse() method is a generic helper for sending JSON-formatted error
 // messages to the client with a given status code. Note that we're using the any
 // type for the message parameter, rather than just a string type, as this gives us
-// more flexibility over the values that we can include in the response.
+// more flexibility over the values that we can include in the response. The request ID
+// is included so that users can quote it when reporting a problem.
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
 	env := envelope{"error": message}
 
+	if id := app.contextGetRequestID(r); id != "" {
+		env["request_id"] = id
+	}
+
 	// Write the response using the writeJSON() helper. If this happens to return an
 	// error then log it, and fall back to sending the client an empty response with a
 	// 500 Internal Server Error status code.
-	err := app.writeJSON(w, status, env, nil, r)
+	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
@@ -73,12 +82,29 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusBadRequest, message)
 }
 
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the Idempotency-Key has already been used for a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+func (app *application) idempotencyKeyInUseResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	message := "a request with this Idempotency-Key is still being processed, please try again"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 
 }
 
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -96,6 +122,11 @@ func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) accountDeactivatedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this account has been deactivated by an administrator"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
@@ -106,3 +137,24 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) delegatedAccessNotPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource is not available to third-party applications"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// The oauthErrorResponse() method sends an error in the format defined by RFC 6749
+// section 5.2, which OAuth client libraries expect from the token endpoint.
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	env := envelope{"error": code, "error_description": description}
+
+	if id := app.contextGetRequestID(r); id != "" {
+		env["request_id"] = id
+	}
+
+	err := app.writeJSON(w, status, env, http.Header{"Cache-Control": {"no-store"}})
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
@@ -18,7 +18,7 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 	// Pass the map to the json.Marshal() function. This returns a []byte slice
 	// containing the encoded JSON. If there was an error, we log it and send the client
 	// a generic error message.
-	err := app.writeJSON(w, http.StatusOK, data, nil, r)
+	err := app.writeJSON(w, http.StatusOK, data, nil)
 	if err != nil {
 		// Use the new serverErrorResponse() helper.
 		app.serverErrorResponse(w, r, err)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel/codes"
+	"greenlight.mpdev.com/internal/data"
 	"greenlight.mpdev.com/internal/validator"
 )
 
@@ -85,7 +88,7 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int,
 // Define an envelope type.
 type envelope map[string]any
 
-func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header, requestInfo *http.Request) error {
+func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 	// Encode the data to JSON, returning the error if there was one.
 	// Use the json.MarshalIndent() function so that whitespace is added to the encoded
 	// JSON. Here we use no line prefix ("") and tab indents ("\t") for each element.
@@ -112,20 +115,6 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	w.WriteHeader(status)
 	w.Write(js)
 
-	var Red = "\033[31m"
-	var Green = "\033[32m"
-	var Yellow = "\033[33m"
-	var Blue = "\033[34m"
-	var Gray = "\033[37m"
-	var Reset = "\033[0m"
-	var Color = Red
-	if status == 200 || status == 201 || status == 202 {
-		Color = Green
-	}
-
-	// log request info in to output
-	fmt.Printf(Yellow+"%s"+Reset+" "+Gray+"requested on"+Reset+" "+Blue+"%s"+Reset+""+Color+" %d"+Reset+"\n", requestInfo.Method, strings.Split(requestInfo.RequestURI, "?")[0], status)
-
 	return nil
 }
 
@@ -223,8 +212,11 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
-// The background() helper accepts an arbitrary function as a parameter.
-func (app *application) background(fn func()) {
+// The background() helper runs fn in a goroutine tracked by app.wg, in a span named
+// name. The context passed to fn carries the values of ctx, such as the request ID and
+// the request's span, but isn't cancelled along with it, since background tasks
+// usually outlive the request which started them.
+func (app *application) background(ctx context.Context, name string, fn func(ctx context.Context)) {
 
 	// Increment the WaitGroup counter.
 	app.wg.Add(1)
@@ -235,13 +227,34 @@ func (app *application) background(fn func()) {
 		// Use defer to decrement the WaitGroup counter before the goroutine returns.
 		defer app.wg.Done()
 
+		ctx, span := tracer.Start(context.WithoutCancel(ctx), name)
+		defer span.End()
+
+		promBackgroundTasksRunning.Inc()
+		defer promBackgroundTasksRunning.Dec()
+
 		// Recover any panic.
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.Printf("%s", err)
+				promBackgroundTasks.WithLabelValues(name, "panic").Inc()
+				span.SetStatus(codes.Error, fmt.Sprintf("%v", err))
+				app.logger.ErrorContext(ctx, fmt.Sprintf("%v", err))
+				return
 			}
+			promBackgroundTasks.WithLabelValues(name, "ok").Inc()
 		}()
 		// Execute the arbitrary function that we passed as the parameter.
-		fn()
+		fn(ctx)
 	}()
 }
+
+// The deactivated() helper reports whether an administrator has deactivated the user.
+// Such accounts were activated once, and only an administrator can activate them again,
+// so they can't be activated with a new activation token or used to sign in.
+func (app *application) deactivated(ctx context.Context, user *data.User) (bool, error) {
+	if user.Activated {
+		return false, nil
+	}
+
+	return app.models.Users.WasActivated(ctx, user.ID)
+}
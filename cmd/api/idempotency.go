@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"greenlight.mpdev.com/internal/data"
+)
+
+// The response headers stored with an idempotency key and replayed with the response.
+// Others, like X-Request-ID and the RateLimit headers, belong to the retried request.
+var idempotentHeaders = []string{"Content-Type", "Location", "ETag", "Last-Modified"}
+
+// The idempotent() middleware makes requests to a route which carry an Idempotency-Key
+// header safe to retry. The first request with a key is handled as normal and its
+// response stored for -idempotency-ttl; a retry with the same key and the same method,
+// URL and body gets the stored response again, with an Idempotency-Replayed header,
+// instead of being handled twice. Reusing a key for a different request is rejected,
+// as is a retry which arrives while the first request is still being handled.
+// Responses with a 5xx status aren't stored, so that the request can be retried.
+//
+// Routes opt in by wrapping their handler. The response is stored as it was sent, so
+// it must never be used on a route whose response contains credentials, like the
+// token endpoints.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !validIdempotencyKey(key) {
+			app.badRequestResponse(w, r, errors.New("the Idempotency-Key header must be 1 to 255 printable ASCII characters"))
+			return
+		}
+
+		// Read the body to fingerprint the request, then put it back for the handler.
+		// We apply the same limit as readJSON().
+		maxBytes := 1_048_576
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBytes)))
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxBytesError):
+				app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytes))
+			default:
+				app.badRequestResponse(w, r, err)
+			}
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := sha256.Sum256([]byte(r.Method + " " + r.URL.RequestURI() + "\n" + string(body)))
+
+		record := &data.IdempotencyKey{
+			Scope:       app.idempotencyScope(r),
+			Key:         key,
+			Fingerprint: fingerprint[:],
+			Expiry:      time.Now().Add(app.config.idempotency.ttl),
+		}
+
+		claimed, err := app.models.Idempotency.Claim(r.Context(), record)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !claimed {
+			stored, err := app.models.Idempotency.Get(r.Context(), record.Scope, key)
+			if err != nil {
+				switch {
+				// The key expired, or the first request failed, since we tried to
+				// claim it.
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.idempotencyKeyInUseResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			switch {
+			case !bytes.Equal(stored.Fingerprint, record.Fingerprint):
+				app.idempotencyKeyMismatchResponse(w, r)
+			case stored.Status == 0:
+				app.idempotencyKeyInUseResponse(w, r)
+			default:
+				for name, values := range stored.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotency-Replayed", "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		// Store the response even if the client has gone away, since it's the client
+		// most likely to retry.
+		ctx := context.WithoutCancel(r.Context())
+
+		// Release the key if the handler fails with a 5xx status or panics, so that the
+		// request can be retried rather than being reported as in progress until the key
+		// expires.
+		completed := false
+		defer func() {
+			if !completed {
+				err := app.models.Idempotency.Delete(ctx, record.Scope, key)
+				if err != nil {
+					app.logError(r, err)
+				}
+			}
+		}()
+
+		var buf bytes.Buffer
+
+		hooks := httpsnoop.Hooks{
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					if record.Status == 0 && code >= 200 {
+						record.Status = code
+						record.Header = storedHeader(w.Header())
+					}
+					next(code)
+				}
+			},
+			Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return func(b []byte) (int, error) {
+					if record.Status == 0 {
+						record.Status = http.StatusOK
+						record.Header = storedHeader(w.Header())
+					}
+					buf.Write(b)
+					return next(b)
+				}
+			},
+		}
+
+		next.ServeHTTP(httpsnoop.Wrap(w, hooks), r)
+
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+			record.Header = storedHeader(w.Header())
+		}
+
+		if record.Status >= 500 {
+			return
+		}
+
+		record.Body = buf.Bytes()
+
+		err = app.models.Idempotency.Complete(ctx, record)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+
+		completed = true
+	}
+}
+
+// The idempotencyScope() helper returns the scope of the request's Idempotency-Key:
+// the user for authenticated requests, and otherwise the client's IP address, so that
+// anonymous clients which happen to pick the same key don't share responses.
+func (app *application) idempotencyScope(r *http.Request) string {
+	user := app.contextGetUser(r)
+	if !user.IsAnonymous() {
+		return "user:" + strconv.FormatInt(user.ID, 10)
+	}
+
+	return "ip:" + app.contextGetClientIP(r)
+}
+
+// The storedHeader() helper returns the headers in idempotentHeaders which are set.
+func storedHeader(header http.Header) http.Header {
+	stored := http.Header{}
+
+	for _, name := range idempotentHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			stored[name] = values
+		}
+	}
+
+	return stored
+}
+
+// The validIdempotencyKey() helper checks a key supplied by the client. Clients should
+// send a UUID or another random value, but any printable ASCII up to 255 characters is
+// accepted.
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > 255 {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"greenlight.mpdev.com/internal/data"
+	"greenlight.mpdev.com/internal/validator"
+)
+
+// Invite someone to register. The invitation is emailed to them, and when redeemed it
+// creates an activated account with the given permissions. Invitations are the only
+// way to register when the server runs with -registration-invite-only.
+func (app *application) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email       string     `json:"email"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	actor := app.contextGetUser(r)
+
+	invitation := &data.Invitation{
+		Email:       input.Email,
+		Permissions: input.Permissions,
+		InvitedBy:   &actor.ID,
+		Expiry:      time.Now().Add(7 * 24 * time.Hour),
+	}
+
+	if input.Expiry != nil {
+		invitation.Expiry = *input.Expiry
+	}
+
+	// New users get the same permission as those who sign up themselves, unless the
+	// invitation says otherwise.
+	if invitation.Permissions == nil {
+		invitation.Permissions = []string{"movies:read"}
+	}
+
+	known, err := app.models.Permissions.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateInvitation(v, invitation, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Transaction(r.Context(), func(tx data.Models) error {
+		err := tx.Invitations.Insert(r.Context(), invitation)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, data.AuditInvitationCreated, 0, map[string]any{
+			"invitation_id": invitation.ID,
+			"email":         invitation.Email,
+			"permissions":   invitation.Permissions,
+		})
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(r.Context(), "send invitation email", func(ctx context.Context) {
+		data := map[string]interface{}{
+			"invitationToken": invitation.Plaintext,
+			"invitedBy":       actor.Name,
+			"expiry":          invitation.Expiry.UTC().Format(time.RFC1123),
+		}
+
+		err := app.mailer.Send(ctx, invitation.Email, "invitation.tmpl", data)
+		if err != nil {
+			app.logger.ErrorContext(ctx, err.Error())
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	invitations, err := app.models.Invitations.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"invitations": invitations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Transaction(r.Context(), func(tx data.Models) error {
+		err := tx.Invitations.Delete(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, data.AuditInvitationRevoked, 0, map[string]any{"invitation_id": id})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "invitation successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"greenlight.mpdev.com/internal/data"
+	"greenlight.mpdev.com/internal/validator"
+)
+
+// The loginRetryAfter() helper returns how long the user must wait before their next
+// login attempt will be considered. Each consecutive failure doubles the wait, starting
+// at the configured backoff, and once the maximum number of attempts is reached the
+// account is locked for the full lockout duration.
+func (app *application) loginRetryAfter(attempt *data.LoginAttempt) time.Duration {
+	now := time.Now()
+
+	if attempt.Locked(now) {
+		return attempt.LockedUntil.Sub(now)
+	}
+
+	if attempt.FailedCount == 0 {
+		return 0
+	}
+
+	backoff := app.config.login.lockout
+	if n := attempt.FailedCount - 1; n < 32 {
+		backoff = min(app.config.login.backoff<<n, backoff)
+	}
+
+	return time.Until(attempt.LastFailedAt.Add(backoff))
+}
+
+// The reserveLoginAttempt() helper counts an attempt to prove the user's identity as a
+// failure before the credentials are checked, so that concurrent guesses are throttled
+// too. It sends a 429 Too Many Requests response and returns false if the user is
+// currently backing off or locked out. If the credentials turn out to be correct the
+// caller should reset the counter, or release the attempt if another factor is still
+// to come; otherwise it should call recordFailedLogin().
+func (app *application) reserveLoginAttempt(w http.ResponseWriter, r *http.Request, user *data.User) (*data.LoginAttempt, bool) {
+	attempt, reserved, err := app.models.LoginAttempts.Reserve(r.Context(), user.ID, app.config.login.backoff, app.config.login.lockout)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if reserved {
+		return attempt, true
+	}
+
+	attempt, err = app.models.LoginAttempts.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	// The wait may have just run out, but the client can simply try again.
+	app.tooManyLoginAttemptsResponse(w, r, max(app.loginRetryAfter(attempt), time.Second))
+	return nil, false
+}
+
+// The recordFailedLogin() helper is called when the credentials for an attempt reserved
+// by reserveLoginAttempt() are wrong. It locks the account, notifying the user by
+// email, once the configured maximum number of attempts has been reached.
+func (app *application) recordFailedLogin(r *http.Request, user *data.User, attempt *data.LoginAttempt) error {
+	if attempt.FailedCount < app.config.login.maxAttempts || attempt.Locked(time.Now()) {
+		return nil
+	}
+
+	lockedUntil := time.Now().Add(app.config.login.lockout)
+
+	err := app.models.LoginAttempts.Lock(r.Context(), user.ID, lockedUntil)
+	if err != nil {
+		return err
+	}
+
+	app.background(r.Context(), "send account locked email", func(ctx context.Context) {
+		data := map[string]interface{}{
+			"failedCount": attempt.FailedCount,
+			"lockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+		}
+
+		err := app.mailer.Send(ctx, user.Email, "account_locked.tmpl", data)
+		if err != nil {
+			app.logger.ErrorContext(ctx, err.Error())
+		}
+	})
+
+	return nil
+}
+
+// The verifyCurrentPassword() helper checks the password a signed-in user gives to
+// confirm a sensitive change, under the same throttle and lockout as logins, so that a
+// stolen token can't be used to guess the password. It sends an error response and
+// returns false if the password is wrong or the user has to wait.
+func (app *application) verifyCurrentPassword(w http.ResponseWriter, r *http.Request, user *data.User, password string) bool {
+	attempt, ok := app.reserveLoginAttempt(w, r, user)
+	if !ok {
+		return false
+	}
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !match {
+		err = app.recordFailedLogin(r, user, attempt)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+
+		v := validator.New()
+		v.AddError("current_password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	err = app.models.LoginAttempts.Reset(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"greenlight.mpdev.com/internal/data"
+	"greenlight.mpdev.com/internal/validator"
+)
+
+// Email the user a single-use link which signs them in without a password. We respond
+// the same way whether or not the email address belongs to an account, so that this
+// endpoint can't be used to find out who has signed up. Accounts which aren't activated
+// get the same response, but no link, since they couldn't sign in with it anyway.
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if an account exists for this email address, a sign-in link will be sent to it"}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated {
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, app.config.magicLink.ttl, data.ScopeLogin)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	link, err := url.Parse(app.config.magicLink.url)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	query := link.Query()
+	query.Set("token", token.Plaintext)
+	link.RawQuery = query.Encode()
+
+	app.background(r.Context(), "send magic link email", func(ctx context.Context) {
+		data := map[string]interface{}{
+			"link":       link.String(),
+			"loginToken": token.Plaintext,
+			"ttl":        fmt.Sprintf("%.0f minutes", app.config.magicLink.ttl.Minutes()),
+		}
+
+		err := app.mailer.Send(ctx, user.Email, "magic_link.tmpl", data)
+		if err != nil {
+			app.logger.ErrorContext(ctx, err.Error())
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchange a magic link token for an authentication token. The token is deleted as it
+// is checked, along with any other outstanding links for the user, and the login then
+// carries on through completeLogin() so that two-factor authentication still applies.
+func (app *application) createMagicLinkAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userID, err := app.models.Tokens.Consume(r.Context(), data.ScopeLogin, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired sign-in token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeLogin, userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired sign-in token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
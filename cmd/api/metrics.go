@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Requests are labelled with the pattern of the route which matched them, like
+// "/v1/movies/:id", so that each route is one time series however many IDs it's called
+// with. Requests no route matched are labelled "unmatched".
+var (
+	promHTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_metrics",
+		Subsystem: "prometheus",
+		Name:      "http_requests_total",
+		Help:      "Total number of API requests by HTTP code, method and route.",
+	}, []string{"code", "method", "route"})
+
+	promHTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "go_metrics",
+		Subsystem: "prometheus",
+		Name:      "http_request_duration_seconds",
+		Help:      "Histogram of request durations in seconds, by method and route.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method", "route"})
+
+	promHTTPResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "go_metrics",
+		Subsystem: "prometheus",
+		Name:      "http_response_size_bytes",
+		Help:      "Histogram of response body sizes in bytes, by method and route.",
+		Buckets:   prometheus.ExponentialBuckets(100, 10, 6),
+	}, []string{"method", "route"})
+
+	promHTTPRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "go_metrics",
+		Subsystem: "prometheus",
+		Name:      "http_requests_in_flight",
+		Help:      "Number of requests currently being served.",
+	})
+
+	promBackgroundTasks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_metrics",
+		Subsystem: "prometheus",
+		Name:      "background_tasks_total",
+		Help:      "Background tasks run, by task and result (ok or panic).",
+	}, []string{"task", "result"})
+
+	promBackgroundTasksRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "go_metrics",
+		Subsystem: "prometheus",
+		Name:      "background_tasks_running",
+		Help:      "Number of background tasks currently running.",
+	})
+)
+
+// The metricsRoute() helper returns the route label for a request.
+func metricsRoute(info *requestInfo) string {
+	if info.route == "" {
+		return "unmatched"
+	}
+
+	return info.route
+}
+
+// Define a poolCollector type to export the statistics of the database connection
+// pool. The values are read from the pool each time the metrics are scraped.
+type poolCollector struct {
+	db *pgxpool.Pool
+
+	acquireCount            *prometheus.Desc
+	acquireDuration         *prometheus.Desc
+	canceledAcquireCount    *prometheus.Desc
+	emptyAcquireCount       *prometheus.Desc
+	newConnsCount           *prometheus.Desc
+	maxLifetimeDestroyCount *prometheus.Desc
+	maxIdleDestroyCount     *prometheus.Desc
+	acquiredConns           *prometheus.Desc
+	constructingConns       *prometheus.Desc
+	idleConns               *prometheus.Desc
+	totalConns              *prometheus.Desc
+	maxConns                *prometheus.Desc
+}
+
+func newPoolCollector(db *pgxpool.Pool) *poolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("go_metrics", "database", name), help, nil, nil)
+	}
+
+	return &poolCollector{
+		db:                      db,
+		acquireCount:            desc("acquire_total", "Connections acquired from the pool."),
+		acquireDuration:         desc("acquire_duration_seconds_total", "Time spent acquiring connections from the pool."),
+		canceledAcquireCount:    desc("canceled_acquire_total", "Acquires cancelled by their context."),
+		emptyAcquireCount:       desc("empty_acquire_total", "Acquires which had to wait for a connection because the pool was empty."),
+		newConnsCount:           desc("new_connections_total", "Connections opened."),
+		maxLifetimeDestroyCount: desc("max_lifetime_destroyed_total", "Connections closed because they reached their maximum lifetime."),
+		maxIdleDestroyCount:     desc("max_idle_destroyed_total", "Connections closed because they were idle for too long."),
+		acquiredConns:           desc("acquired_connections", "Connections currently in use."),
+		constructingConns:       desc("constructing_connections", "Connections currently being opened."),
+		idleConns:               desc("idle_connections", "Connections currently idle."),
+		totalConns:              desc("connections", "Connections currently open."),
+		maxConns:                desc("max_connections", "Maximum size of the pool."),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.db.Stat()
+
+	ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.acquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(c.canceledAcquireCount, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquireCount, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.newConnsCount, prometheus.CounterValue, float64(stat.NewConnsCount()))
+	ch <- prometheus.MustNewConstMetric(c.maxLifetimeDestroyCount, prometheus.CounterValue, float64(stat.MaxLifetimeDestroyCount()))
+	ch <- prometheus.MustNewConstMetric(c.maxIdleDestroyCount, prometheus.CounterValue, float64(stat.MaxIdleDestroyCount()))
+	ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.constructingConns, prometheus.GaugeValue, float64(stat.ConstructingConns()))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+}
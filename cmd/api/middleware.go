@@ -4,18 +4,16 @@ import (
 	"errors"
 	"expvar"
 	"fmt"
-	"net"
+	"math"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/felixge/httpsnoop"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"golang.org/x/time/rate"
 	"greenlight.mpdev.com/internal/data"
+	"greenlight.mpdev.com/internal/ratelimit"
 	"greenlight.mpdev.com/internal/validator"
 )
 
@@ -45,72 +43,146 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
-
-	// Declare a mutex and a map to hold the clients' IP addresses and rate limiters.
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-
-	go func() {
-		for {
-
-			time.Sleep(time.Minute)
-
-			// Lock the mutex to prevent any rate limiter checks from happening while
-			// the cleanup is taking place.
-			mu.Lock()
+// The rateLimitIP() middleware limits each client IP address to limiter-ip-rps and
+// limiter-ip-burst. It runs before authenticate(), so that requests with malformed or
+// unknown tokens, each of which costs a database lookup, are throttled too. The limit
+// is meant to be looser than the policies applied by rateLimit(), which hold
+// authenticated users to their own limits.
+func (app *application) rateLimitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.limiter.enabled {
+			key := "ip:" + app.contextGetClientIP(r)
 
-			// Loop through all clients. If they haven't been seen within the last three
-			// minutes, delete the corresponding entry from the map.
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
+			if !app.allowRequest(w, r, key, app.config.limiter.ipRPS, app.config.limiter.ipBurst) {
+				return
 			}
-			// Importantly, unlock the mutex when the cleanup is complete.
-			mu.Unlock()
 		}
-	}()
 
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The rateLimit() middleware limits each client to the rate set by the first policy in
+// the -limiter-policies file which matches the request, or to limiter-rps and
+// limiter-burst if none does. It runs after authenticate(), so that authenticated users
+// are limited per user rather than per IP address; rateLimitIP() applies a limit per IP
+// address before that. The token buckets live in app.limiter, which is either local to
+// this process or shared between all instances through PostgreSQL (see the
+// -limiter-store flag).
+func (app *application) rateLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		if app.config.limiter.enabled {
-			// Extract the client's IP address from the request.
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			req := ratelimit.Request{
+				Method: r.Method,
+				Path:   r.URL.Path,
+				UserID: app.contextGetUser(r).ID,
+				HasPermission: func(code string) (bool, error) {
+					permissions, err := app.userPermissions(r)
+					if err != nil {
+						return false, err
+					}
+					return permissions.Include(code), nil
+				},
+			}
+
+			policy, err := app.rateLimitPolicy(req)
 			if err != nil {
 				app.serverErrorResponse(w, r, err)
 				return
 			}
 
-			// Lock the mutex to prevent this code from being executed concurrently.
-			mu.Lock()
+			if !app.allowRequest(w, r, policy.Key(req, app.contextGetClientIP(r)), policy.RPS, policy.Burst) {
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The allowRequest() helper takes a token from the bucket for key, describing the
+// bucket in the headers from the IETF RateLimit header fields draft. It sends a 429 Too
+// Many Requests response and returns false if the bucket is empty. If the store can't
+// be reached we log the error and let the request through, rather than failing every
+// request.
+func (app *application) allowRequest(w http.ResponseWriter, r *http.Request, key string, rps float64, burst int) bool {
+	result, err := app.limiter.Allow(r.Context(), key, rps, burst)
+	if err != nil {
+		app.logError(r, err)
+		return true
+	}
 
-			// Check to see if the IP address already exists in the map.  If it doesn't, then
-			// initialize a new rate limiter and add the IP address and limiter to the map.
-			if _, found := clients[ip]; !found {
-				// Allow 2 requests per second, with a maximum of 4 requests in a burst.
-				clients[ip] = &client{limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
 
-			}
-			// Update the last seen time for the client.
-			clients[ip].lastSeen = time.Now()
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+		app.rateLimitExceededResponse(w, r)
+		return false
+	}
 
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
+	return true
+}
+
+// The rateLimitPolicy() helper returns the first configured policy which matches the
+// request, falling back to the default limits from limiter-rps and limiter-burst.
+func (app *application) rateLimitPolicy(req ratelimit.Request) (*ratelimit.Policy, error) {
+	for i := range app.config.limiter.policies {
+		policy := &app.config.limiter.policies[i]
+
+		ok, err := policy.Matches(req)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return policy, nil
+		}
+	}
+
+	return &ratelimit.Policy{
+		Name:  "default",
+		RPS:   app.config.limiter.rps,
+		Burst: app.config.limiter.burst,
+	}, nil
+}
+
+// The requestID() middleware gives every request an ID, which is attached to each line
+// logged for the request, returned in the X-Request-ID response header and included
+// in error responses. A well-formed X-Request-ID header from the client or a proxy in
+// front of us is kept, so that one ID can follow the request across services.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if !validRequestID(id) {
+			var err error
+
+			id, err = generateRequestID()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
 				return
 			}
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
 
-			// middleware have also returned.
-			mu.Unlock()
+// The realIP() middleware resolves the client's IP address, looking through any trusted
+// proxies, and stores it in the request context for the rate limiter, logs and audit
+// log. See clientIP().
+func (app *application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, err := app.clientIP(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
 		}
-		next.ServeHTTP(w, r)
+
+		next.ServeHTTP(w, app.contextSetClientIP(r, ip))
 	})
 }
 
@@ -125,6 +197,16 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 		headerParts := strings.Split(authorizationHeader, " ")
+
+		// OAuth clients send their credentials to the token endpoint using Basic
+		// authentication. That identifies the client rather than a user, so leave the
+		// request anonymous and let the handler check the credentials.
+		if len(headerParts) == 2 && headerParts[0] == "Basic" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -140,7 +222,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, accessToken, err := app.models.Users.GetForAccessToken(r.Context(), token)
 
 		if err != nil {
 			switch {
@@ -154,6 +236,10 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		r = app.contextSetUser(r, user)
 
+		if accessToken.Scope == data.ScopeOAuth {
+			r = app.contextSetTokenScopes(r, accessToken.Scopes)
+		}
+
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
@@ -167,6 +253,14 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 			app.authenticationRequiredResponse(w, r)
 			return
 		}
+
+		// OAuth access tokens may only be used on routes protected by requirePermission(),
+		// where the permissions are limited to the scopes the user granted. Everything
+		// else, like changing the password or approving other clients, is off limits.
+		if _, delegated := app.contextGetTokenScopes(r); delegated && !app.contextGetDelegationAllowed(r) {
+			app.delegatedAccessNotPermittedResponse(w, r)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -190,30 +284,110 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user from the request context.
-		user := app.contextGetUser(r)
-		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		// Get the slice of permissions for the user, and keep it in the request context
+		// for any further checks made by the handler.
+		permissions, err := app.userPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
+		r = app.contextSetPermissions(r, permissions)
+
 		if !permissions.Include(code) {
 			app.notPermittedResponse(w, r)
 			return
 		}
 		next.ServeHTTP(w, r)
 	}
-	return app.requireActivatedUser(fn)
+
+	// Routes protected by a permission are the ones third-party clients may use, since
+	// userPermissions() limits them to their granted scopes.
+	chain := app.requireActivatedUser(fn)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		chain.ServeHTTP(w, app.contextSetDelegationAllowed(r))
+	}
 }
 
+// The userPermissions() helper returns the permissions for the user in the request
+// context. They are taken from the request context if they have already been loaded,
+// then from the permission cache, and only then from the database.
+func (app *application) userPermissions(r *http.Request) (data.Permissions, error) {
+	if permissions, ok := app.contextGetPermissions(r); ok {
+		return permissions, nil
+	}
+
+	user := app.contextGetUser(r)
+
+	permissions, generation, ok := app.permissions.Get(user.ID)
+	if !ok {
+		var err error
+
+		permissions, err = app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		app.permissions.Set(user.ID, generation, permissions)
+	}
+
+	// A third-party client gets at most the scopes it was granted, and never more than
+	// the user themselves currently has.
+	if scopes, ok := app.contextGetTokenScopes(r); ok {
+		permissions = permissions.Intersect(scopes)
+	}
+
+	return permissions, nil
+}
+
+// The enableCORS() middleware allows cross-origin requests from the trusted origins
+// (see corsOrigin()), and answers their preflight requests itself, before they reach
+// the rate limiter or the router. Requests from other origins get no CORS headers, so
+// browsers won't let scripts read the responses.
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		// The response depends on the Origin header, and for preflight requests on the
+		// Access-Control-Request-Method header, so caches must key on both.
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		origin := r.Header.Get("Origin")
+
+		if origin != "" {
+			allowed, credentials := app.corsOrigin(origin)
+
+			if allowed {
+				if credentials {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				} else if slices.Contains(app.config.cors.trustedOrigins, "*") {
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+				} else {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+				}
+
+				// A preflight request is an OPTIONS request with an
+				// Access-Control-Request-Method header.
+				if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+					w.Header().Set("Access-Control-Allow-Methods", strings.Join(app.config.cors.allowedMethods, ", "))
+					w.Header().Set("Access-Control-Allow-Headers", strings.Join(app.config.cors.allowedHeaders, ", "))
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(app.config.cors.maxAge.Seconds())))
+
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			}
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The metrics() middleware counts and times each request, for both the expvar handler
+// and Prometheus, and writes the request to the access log. It also creates the
+// request's requestInfo, which the router and authenticate() fill in.
 func (app *application) metrics(next http.Handler) http.Handler {
 
 	totalRequestsReceived := expvar.NewInt("total_requests_received")
@@ -221,88 +395,30 @@ func (app *application) metrics(next http.Handler) http.Handler {
 	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_μs")
 	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
 
-	var (
-		opsProcessed = promauto.NewCounter(prometheus.CounterOpts{
-			Namespace: "go_metrics",
-			Subsystem: "prometheus",
-			Name:      "processed_record_total",
-			Help:      "process metrics count",
-		})
-
-		opsRequested = promauto.NewGauge(prometheus.GaugeOpts{
-			Namespace: "go_metrics",
-			Subsystem: "prometheus",
-			Name:      "processed_record_count",
-			Help:      "request record count",
-		})
-		promTotalRequestsReceived = promauto.NewGauge(prometheus.GaugeOpts{
-			Namespace: "go_metrics",
-			Subsystem: "prometheus",
-			Name:      "total_requests_received",
-			Help:      "total requests received",
-		})
-
-		promTotalResponsesSentByStatus = promauto.NewCounterVec(prometheus.CounterOpts{
-			Namespace: "go_metrics",
-			Subsystem: "prometheus",
-			Name:      "http_requests_total",
-			Help:      "Total number of API requests by HTTP code.",
-		}, []string{"code", "method", "handler"})
-	)
-
 	// The following code will be run for every request...
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		totalRequestsReceived.Add(1)
+		promHTTPRequestsInFlight.Inc()
+		defer promHTTPRequestsInFlight.Dec()
 
-		metrics := httpsnoop.CaptureMetrics(next, w, r)
+		start := time.Now()
+		info := &requestInfo{}
+		r = app.contextSetRequestInfo(r, info)
 
-		totalResponsesSent.Add(1)
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
 
-		totalProcessingTimeMicroseconds.Add(metrics.Duration.Microseconds())
+		app.logAccess(r, start, info, metrics)
 
 		totalResponsesSent.Add(1)
-
+		totalProcessingTimeMicroseconds.Add(metrics.Duration.Microseconds())
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
 
-		// prometheus metrics
-		// Record the duration in microseconds
-		//duration := float64(time.Since(start).Microseconds())
-		//timer := prometheus.NewTimer(promHttpRequestDuration.WithLabelValues(strings.Split(r.RequestURI, "?")[0]))
-		//defer timer.ObserveDuration()
-		//fmt.Printf("hello from muiddleware on %s with %0.0f μs \n", strings.Split(r.RequestURI, "?")[0], float64(metrics.Duration.Microseconds()))
-		//promHttpRequestDuration.WithLabelValues(strings.Split(r.RequestURI, "?")[0]).Observe(float64(metrics.Duration.Microseconds()))
-
-		opsRequested.Add(1)
-		opsProcessed.Add(1)
-
-		promTotalRequestsReceived.Add(1)
-		promTotalResponsesSentByStatus.WithLabelValues(strconv.Itoa(metrics.Code), r.Method, strings.Split(r.RequestURI, "?")[0]).Add(1)
+		route := metricsRoute(info)
 
+		promHTTPRequests.WithLabelValues(strconv.Itoa(metrics.Code), r.Method, route).Inc()
+		promHTTPRequestDuration.WithLabelValues(r.Method, route).Observe(metrics.Duration.Seconds())
+		promHTTPResponseSize.WithLabelValues(r.Method, route).Observe(float64(metrics.Written))
 	})
 
 }
-func (app *application) measureDuration(next http.Handler) http.Handler {
-	var (
-		requestDuration = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Namespace: "go_metrics",
-				Subsystem: "prometheus",
-				Name:      "http_request_duration_seconds",
-				Help:      "Histogram of request durations",
-				Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
-			},
-			[]string{"method", "handler"},
-		)
-	)
-	prometheus.MustRegister(requestDuration)
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		next.ServeHTTP(w, r)
-		duration := time.Since(start)
-
-		//fmt.Printf("hello from muiddleware on %s with %0.0f μs \n", r.URL.Path, float64(duration.Microseconds()))
-		// Observe the duration with method and endpoint labels
-		requestDuration.WithLabelValues(r.Method, r.URL.Path).Observe(float64(duration.Microseconds()))
-	})
-}
@@ -28,10 +28,11 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Copy the values from the input struct to a new Movie struct.
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		Runtime:   input.Runtime,
+		Genres:    input.Genres,
+		CreatedBy: app.contextGetUser(r).ID,
 	}
 	// Initialize a new Validator instance.
 	v := validator.New()
@@ -43,7 +44,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Insert(movie)
+	err = app.models.Movies.Insert(r.Context(), movie)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -52,8 +53,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie},
-		headers, r)
+	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -94,7 +94,7 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// Dump the contents of the input struct in a HTTP response.
 	//fmt.Fprintf(w, "%+v\n", input)
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres,
+	movies, metadata, err := app.models.Movies.GetAll(r.Context(), input.Title, input.Genres,
 		input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -102,7 +102,7 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// Send a JSON response containing the movie data.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil, r)
+	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -120,7 +120,7 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case err.Error() == pgx.ErrNoRows.Error():
@@ -130,7 +130,7 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil, r)
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -144,7 +144,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case err.Error() == pgx.ErrNoRows.Error():
@@ -155,6 +155,11 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Only the movie's owner, or a user with the movies:admin permission, may edit it.
+	if !app.authorizeMovieWrite(w, r, movie) {
+		return
+	}
+
 	// Use pointers for the Title, Year and Runtime fields. Apply partial update
 	var input struct {
 		Title   *string  `json:"title"`   // This will be nil if there is no corresponding key in the JSON.
@@ -191,7 +196,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(r.Context(), movie)
 	if err != nil {
 		switch {
 		case err.Error() == data.ErrEditConflict.Error():
@@ -202,7 +207,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	// Write the updated movie record in a JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil, r)
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -216,7 +221,24 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		app.notFoundResponse(w, r)
 		return
 	}
-	err = app.models.Movies.Delete(id)
+
+	movie, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case err.Error() == pgx.ErrNoRows.Error():
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Only the movie's owner, or a user with the movies:admin permission, may delete it.
+	if !app.authorizeMovieWrite(w, r, movie) {
+		return
+	}
+
+	err = app.models.Movies.Delete(r.Context(), movie.ID)
 
 	if err != nil {
 		switch {
@@ -229,8 +251,33 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Return a 200 OK status code along with a success message.
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "The movie successfully deleted"}, nil, r)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "The movie successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The authorizeMovieWrite() helper checks that the current user may modify the given
+// movie. This is layered on top of requirePermission("movies:write"), which has already
+// run: users may modify the movies they created, and holders of movies:admin may modify
+// any movie. If the check fails it sends a 403 Forbidden response and returns false.
+func (app *application) authorizeMovieWrite(w http.ResponseWriter, r *http.Request, movie *data.Movie) bool {
+	user := app.contextGetUser(r)
+
+	if movie.CreatedBy != 0 && movie.CreatedBy == user.ID {
+		return true
+	}
+
+	permissions, err := app.userPermissions(r)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return false
 	}
+
+	if !permissions.Include("movies:admin") {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
 }
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.mpdev.com/internal/data"
+	"greenlight.mpdev.com/internal/validator"
+)
+
+const (
+	// How long a client has to exchange an authorization code.
+	oauthCodeTTL = 10 * time.Minute
+
+	// How long an OAuth access token is valid for. There are no refresh tokens, so
+	// clients send the user through the authorization flow again once it expires.
+	oauthAccessTokenTTL = time.Hour
+)
+
+// Register a third-party application. Scopes are permission codes, and the client can
+// never be granted more than the scopes it was registered with.
+func (app *application) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential *bool    `json:"confidential"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	client := &data.OAuthClient{
+		UserID:       app.contextGetUser(r).ID,
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		Confidential: true,
+	}
+
+	if input.Confidential != nil {
+		client.Confidential = *input.Confidential
+	}
+
+	known, err := app.models.Permissions.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateOAuthClient(v, client, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.OAuthClients.Insert(r.Context(), client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// This is the only time the client secret is ever shown.
+	err = app.writeJSON(w, http.StatusCreated, envelope{"client": client}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	clients, err := app.models.OAuthClients.GetAllForUser(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Delete a client, which also revokes every access token issued to it.
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+
+	err := app.models.OAuthClients.Delete(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "client successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Define an oauthAuthorizationRequest struct to hold the parameters of an authorization
+// request, as defined by RFC 6749 section 4.1.1 and RFC 7636 for PKCE.
+type oauthAuthorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// Describe an authorization request so that the frontend can show the consent screen.
+// The client redirects the user's browser to the frontend with the request parameters
+// in the query string, and the frontend passes them on here along with the user's
+// authentication token.
+func (app *application) showOAuthAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	req := oauthAuthorizationRequest{
+		ResponseType:        app.readString(qs, "response_type", ""),
+		ClientID:            app.readString(qs, "client_id", ""),
+		RedirectURI:         app.readString(qs, "redirect_uri", ""),
+		Scope:               app.readString(qs, "scope", ""),
+		State:               app.readString(qs, "state", ""),
+		CodeChallenge:       app.readString(qs, "code_challenge", ""),
+		CodeChallengeMethod: app.readString(qs, "code_challenge_method", ""),
+	}
+
+	client, redirectURI, scopes, ok := app.readOAuthAuthorizationRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	env := envelope{
+		"client":       envelope{"client_id": client.ID, "name": client.Name},
+		"redirect_uri": redirectURI,
+		"scopes":       scopes,
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Record the user's decision on an authorization request. Either way we respond with
+// the URL the frontend should send the user's browser to, which carries either the
+// authorization code or an access_denied error back to the client.
+func (app *application) approveOAuthAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		oauthAuthorizationRequest
+		Approved bool `json:"approved"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	client, redirectURI, scopes, ok := app.readOAuthAuthorizationRequest(w, r, input.oauthAuthorizationRequest)
+	if !ok {
+		return
+	}
+
+	params := url.Values{}
+
+	if input.Approved {
+		code := &data.OAuthCode{
+			ClientID:      client.ID,
+			UserID:        app.contextGetUser(r).ID,
+			RedirectURI:   input.RedirectURI,
+			Scopes:        scopes,
+			CodeChallenge: input.CodeChallenge,
+			Expiry:        time.Now().Add(oauthCodeTTL),
+		}
+
+		err = app.models.OAuthCodes.Insert(r.Context(), code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		params.Set("code", code.Plaintext)
+	} else {
+		params.Set("error", "access_denied")
+	}
+
+	if input.State != "" {
+		params.Set("state", input.State)
+	}
+
+	// Registered redirect URIs are validated when the client is registered, so they
+	// always parse.
+	u, _ := url.Parse(redirectURI)
+
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"redirect_to": u.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readOAuthAuthorizationRequest() helper validates an authorization request and
+// returns the client, the redirect URI to use and the requested scopes. If the request
+// is invalid it sends a 422 Unprocessable Entity response and returns false. Scopes
+// default to everything the client was registered with, and PKCE is mandatory for
+// public clients since they have no secret to prove who they are.
+func (app *application) readOAuthAuthorizationRequest(w http.ResponseWriter, r *http.Request, req oauthAuthorizationRequest) (*data.OAuthClient, string, []string, bool) {
+	v := validator.New()
+
+	v.Check(req.ResponseType == "code", "response_type", "must be code")
+	v.Check(req.ClientID != "", "client_id", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, "", nil, false
+	}
+
+	client, err := app.models.OAuthClients.Get(r.Context(), req.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("client_id", "must be a registered client")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, "", nil, false
+	}
+
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+
+	v.Check(client.HasRedirectURI(redirectURI), "redirect_uri", "must be one of the client's registered redirect URIs")
+
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+
+	v.Check(validator.Unique(scopes), "scope", "must not contain duplicate values")
+	v.Check(client.AllowsScopes(scopes), "scope", "must only contain scopes the client is registered for")
+
+	v.Check(req.CodeChallenge != "" || client.Confidential, "code_challenge", "must be provided for public clients")
+
+	if req.CodeChallenge != "" {
+		v.Check(req.CodeChallengeMethod == "S256", "code_challenge_method", "must be S256")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, "", nil, false
+	}
+
+	return client, redirectURI, scopes, true
+}
+
+// Issue an OAuth access token. As required by RFC 6749 the request is form-encoded and
+// errors use the standard OAuth error codes. We support the authorization_code grant,
+// for clients acting on behalf of a user who approved them, and the client_credentials
+// grant, for confidential clients acting on behalf of the user who registered them.
+func (app *application) createOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "the request body could not be parsed")
+		return
+	}
+
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	var (
+		userID int64
+		scopes []string
+	)
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, err := app.models.OAuthCodes.Consume(r.Context(), r.PostForm.Get("code"))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the authorization code is invalid or has expired")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the authorization code was not issued for this client or redirect_uri")
+			return
+		}
+
+		if code.CodeChallenge != "" && !verifyCodeChallenge(code.CodeChallenge, r.PostForm.Get("code_verifier")) {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the code_verifier does not match the code_challenge")
+			return
+		}
+
+		userID = code.UserID
+		scopes = code.Scopes
+
+	case "client_credentials":
+		if !client.Confidential {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "unauthorized_client", "public clients cannot use the client_credentials grant")
+			return
+		}
+
+		scopes = strings.Fields(r.PostForm.Get("scope"))
+		if len(scopes) == 0 {
+			scopes = client.Scopes
+		}
+
+		if !client.AllowsScopes(scopes) {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "the client is not registered for the requested scope")
+			return
+		}
+
+		userID = client.UserID
+
+	default:
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or client_credentials")
+		return
+	}
+
+	token, err := app.models.Tokens.NewForClient(r.Context(), userID, client.ID, scopes, oauthAccessTokenTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(oauthAccessTokenTTL.Seconds()),
+		"scope":        strings.Join(scopes, " "),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, http.Header{"Cache-Control": {"no-store"}})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The authenticateOAuthClient() helper identifies the client making a token request,
+// from either Basic authentication or the client_id and client_secret form fields.
+// Confidential clients must supply their secret. If authentication fails it sends an
+// invalid_client error and returns false.
+func (app *application) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) (*data.OAuthClient, bool) {
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := app.models.OAuthClients.Get(r.Context(), clientID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if client == nil || (client.Confidential && !client.MatchesSecret(secret)) {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, false
+	}
+
+	return client, true
+}
+
+// The verifyCodeChallenge() helper checks a PKCE code verifier against the S256 code
+// challenge from the authorization request.
+func verifyCodeChallenge(challenge, verifier string) bool {
+	hash := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(hash[:])
+
+	return verifier != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"greenlight.mpdev.com/internal/data"
+)
+
+// How long a user has to complete the login at the identity provider.
+const oidcLoginTTL = 10 * time.Minute
+
+// The cookie which binds a login's state to the browser that started it.
+const oidcStateCookie = "oidc_state"
+
+// Errors returned by oidcUser() when the user may not sign in.
+var (
+	errAccountDeactivated = errors.New("account deactivated")
+	errInviteOnly         = errors.New("registration is invite-only")
+)
+
+// Define an oidcProvider struct to hold the OAuth2 client configuration and ID token
+// verifier for the configured OpenID Connect identity provider.
+type oidcProvider struct {
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// The newOIDCProvider() function fetches the provider's discovery document from
+// <issuer>/.well-known/openid-configuration and sets up the client. The issuer is
+// configurable, so any compliant provider works, including a local mock issuer.
+func newOIDCProvider(cfg config) (*oidcProvider, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	provider, err := oidc.NewProvider(ctx, cfg.oidc.issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oidcProvider{
+		oauth2: oauth2.Config{
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURL:  cfg.oidc.redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.oidc.clientID}),
+	}, nil
+}
+
+// Start an OpenID Connect login by redirecting the user to the identity provider. We
+// use the authorization code flow with PKCE, and remember the state, nonce and code
+// verifier so that we can check them when the provider redirects back.
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := randomString()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	nonce, err := randomString()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	login := &data.OIDCLogin{
+		State:        state,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		Nonce:        nonce,
+		Expiry:       time.Now().Add(oidcLoginTTL),
+	}
+
+	err = app.models.OIDCLogins.Insert(r.Context(), login)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Remember the state in the browser too, so that the callback only completes a login
+	// which this browser started. Otherwise an attacker could send the victim to the
+	// callback with the attacker's own code and state, signing them in as the attacker.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/v1/oidc",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.config.oidc.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	url := app.oidc.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(login.CodeVerifier))
+
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// Handle the redirect back from the identity provider. We exchange the authorization
+// code for tokens, validate the ID token and then sign the user in, provisioning a new
+// account the first time we see a verified email address.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	if errCode := qs.Get("error"); errCode != "" {
+		app.errorResponse(w, r, http.StatusUnauthorized, fmt.Sprintf("the identity provider returned an error: %s", errCode))
+		return
+	}
+
+	// The state cookie is single use, like the state itself.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/v1/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.config.oidc.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(qs.Get("state"))) != 1 {
+		app.badRequestResponse(w, r, errors.New("login state does not match this browser"))
+		return
+	}
+
+	login, err := app.models.OIDCLogins.Consume(r.Context(), qs.Get("state"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.badRequestResponse(w, r, errors.New("invalid or expired login state"))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	token, err := app.oidc.oauth2.Exchange(ctx, qs.Get("code"), oauth2.VerifierOption(login.CodeVerifier))
+	if err != nil {
+		app.logError(r, err)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		app.logError(r, errors.New("token response did not contain an id_token"))
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	idToken, err := app.oidc.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		app.logError(r, err)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if idToken.Nonce != login.Nonce {
+		app.logError(r, errors.New("id_token nonce does not match"))
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+
+	err = idToken.Claims(&claims)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// We match accounts by email address, so we must only trust addresses which the
+	// provider has verified.
+	if claims.Email == "" || !claims.EmailVerified {
+		app.errorResponse(w, r, http.StatusForbidden, "the identity provider did not supply a verified email address")
+		return
+	}
+
+	user, err := app.oidcUser(r.Context(), claims.Email, claims.Name)
+	if err != nil {
+		switch {
+		case errors.Is(err, errAccountDeactivated):
+			app.accountDeactivatedResponse(w, r)
+		case errors.Is(err, errInviteOnly):
+			app.errorResponse(w, r, http.StatusForbidden, "registration is by invitation only, and there is no account with this email address")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A locked account stays locked, however the user signs in.
+	attempt, err := app.models.LoginAttempts.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if attempt.Locked(time.Now()) {
+		app.tooManyLoginAttemptsResponse(w, r, time.Until(*attempt.LockedUntil))
+		return
+	}
+
+	// The identity provider stands in for the password, but users who have enabled
+	// two-factor authentication still have to present their second factor.
+	app.completeLogin(w, r, user)
+}
+
+// The oidcUser() helper returns the user with the given verified email address,
+// creating an activated account with the default permissions if there isn't one yet.
+// It returns errAccountDeactivated for accounts which an administrator deactivated,
+// and errInviteOnly rather than creating an account when registration is invite-only.
+func (app *application) oidcUser(ctx context.Context, email, name string) (*data.User, error) {
+	user, err := app.models.Users.GetByEmail(ctx, email)
+	switch {
+	case err == nil:
+		if !user.Activated {
+			deactivated, err := app.deactivated(ctx, user)
+			if err != nil {
+				return nil, err
+			}
+
+			if deactivated {
+				return nil, errAccountDeactivated
+			}
+
+			err = app.activateForOIDC(ctx, user)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return user, nil
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	if app.config.registration.inviteOnly {
+		return nil, errInviteOnly
+	}
+
+	if name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+
+	user = &data.User{
+		Name:      name,
+		Email:     email,
+		Activated: true,
+	}
+
+	// Accounts provisioned this way sign in through the identity provider, so give
+	// them a random password which nobody knows.
+	password, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Users.Insert(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Permissions.AddForUser(ctx, user.ID, "movies:read")
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// The activateForOIDC() helper activates an account which was never activated, now that
+// the provider has verified the address, which is all activation proves. Whoever signed
+// up with the address may not have owned it, so the password they chose is replaced
+// with a random one and any tokens issued to them are revoked.
+func (app *application) activateForOIDC(ctx context.Context, user *data.User) error {
+	password, err := randomString()
+	if err != nil {
+		return err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return err
+	}
+
+	user.Activated = true
+
+	err = app.models.Users.Update(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	return app.models.Tokens.DeleteAllScopesForUser(ctx, user.ID)
+}
+
+// The randomString() helper returns 32 random bytes, base64url-encoded.
+func randomString() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"greenlight.mpdev.com/internal/data"
+)
+
+var (
+	permissionCacheHits   = expvar.NewInt("permissions_cache_hits")
+	permissionCacheMisses = expvar.NewInt("permissions_cache_misses")
+
+	promPermissionCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_metrics",
+		Subsystem: "prometheus",
+		Name:      "permissions_cache_lookups_total",
+		Help:      "Permission cache lookups by result (hit or miss).",
+	}, []string{"result"})
+)
+
+// Define a permissionCache type which holds recently loaded permissions keyed by user
+// ID. Entries expire after a fixed TTL, and once the cache is full the least recently
+// used entry is evicted. The cache is local to this process, so after a grant or revoke
+// other instances keep serving the old permissions until their entries expire.
+//
+// Each Invalidate() bumps the cache's generation. A miss returns the generation it saw,
+// and Set() drops permissions loaded under an older one, since they may have been read
+// from the database before the change which invalidated them was committed.
+type permissionCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	size       int
+	generation uint64
+	entries    map[int64]*list.Element
+	order      *list.List // Most recently used at the front.
+}
+
+type permissionCacheEntry struct {
+	userID      int64
+	permissions data.Permissions
+	expires     time.Time
+}
+
+// newPermissionCache() returns a cache holding at most size entries for ttl each. A
+// zero size or ttl disables caching.
+func newPermissionCache(size int, ttl time.Duration) *permissionCache {
+	return &permissionCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[int64]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get() returns the cached permissions for the user. On a miss it returns the current
+// generation instead, which should be passed to Set() with the permissions loaded from
+// the database.
+func (c *permissionCache) Get(userID int64) (data.Permissions, uint64, bool) {
+	// Don't count lookups in a disabled cache as misses, or the hit ratio is
+	// meaningless.
+	if c.size <= 0 || c.ttl <= 0 {
+		return nil, 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[userID]
+	if !found {
+		c.recordMiss()
+		return nil, c.generation, false
+	}
+
+	entry := elem.Value.(*permissionCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, userID)
+		c.recordMiss()
+		return nil, c.generation, false
+	}
+
+	c.order.MoveToFront(elem)
+	c.recordHit()
+	return entry.permissions, c.generation, true
+}
+
+// Set() caches permissions loaded after a miss in the given generation. They are
+// dropped if the cache has been invalidated since.
+func (c *permissionCache) Set(userID int64, generation uint64, permissions data.Permissions) {
+	if c.size <= 0 || c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	entry := &permissionCacheEntry{
+		userID:      userID,
+		permissions: permissions,
+		expires:     time.Now().Add(c.ttl),
+	}
+
+	if elem, found := c.entries[userID]; found {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[userID] = c.order.PushFront(entry)
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*permissionCacheEntry).userID)
+	}
+}
+
+// Invalidate() drops any cached permissions for the user. Call it whenever the user's
+// permissions or roles change.
+func (c *permissionCache) Invalidate(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	if elem, found := c.entries[userID]; found {
+		c.order.Remove(elem)
+		delete(c.entries, userID)
+	}
+}
+
+func (c *permissionCache) recordHit() {
+	permissionCacheHits.Add(1)
+	promPermissionCacheLookups.WithLabelValues("hit").Inc()
+}
+
+func (c *permissionCache) recordMiss() {
+	permissionCacheMisses.Add(1)
+	promPermissionCacheLookups.WithLabelValues("miss").Inc()
+}
@@ -9,8 +9,9 @@ import (
 )
 
 func (app *application) routes() http.Handler {
-	// Initialize a new httprouter router instance.
-	router := httprouter.New()
+	// Initialize a new httprouter router instance, wrapped to record which route
+	// matched each request.
+	router := appRouter{Router: httprouter.New(), app: app}
 
 	// Convert the notFoundResponse() helper to a http.Handler using the
 	// http.HandlerFunc() adapter, and then set it as the custom error handler for 404
@@ -25,7 +26,7 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler) //Show application information
 
 	// Movies
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler)) // Create a new movie
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.idempotent(app.createMovieHandler))) // Create a new movie
 
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))    // Show the details of all Movies
 	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler)) // Show the details of a specific movie
@@ -35,18 +36,77 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler)) // Delete a specific movie
 
 	// Users
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)          // Register a new user
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler) //Activate a specific user
+	router.HandlerFunc(http.MethodPost, "/v1/users", app.idempotent(app.registerUserHandler))                         // Register a new user
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)                                //Activate a specific user
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))      // Show the current user
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireActivatedUser(app.updateCurrentUserHandler))      // Update the current user
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireAuthenticatedUser(app.deleteCurrentUserHandler)) // Delete the current user
+	router.HandlerFunc(http.MethodPut, "/v1/users/email/confirmed", app.confirmEmailChangeHandler)                    // Confirm an email address change
+
+	// Two-factor authentication
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireActivatedUser(app.createTOTPHandler))           // Start TOTP enrollment
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/totp/confirmed", app.requireActivatedUser(app.confirmTOTPHandler)) // Confirm TOTP enrollment
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireActivatedUser(app.deleteTOTPHandler))         // Disable TOTP
 
 	// POST /v1/tokens/activation endpoint.
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler) //Generate a new activation token
 
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler) //Generate a new authentication token
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)      //Generate a new authentication token
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/two-factor", app.createTwoFactorAuthenticationTokenHandler) //Exchange a two-factor challenge for an authentication token
+
+	// Passwordless sign-in by emailed link, only available when enabled.
+	if app.config.magicLink.enabled {
+		router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkTokenHandler)                              // Email a sign-in link
+		router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication/magic-link", app.createMagicLinkAuthenticationTokenHandler) // Exchange a sign-in link token for an authentication token
+	}
+
+	// OpenID Connect login, only available when an identity provider is configured.
+	if app.oidc != nil {
+		router.HandlerFunc(http.MethodGet, "/v1/oidc/login", app.oidcLoginHandler)       // Redirect to the identity provider
+		router.HandlerFunc(http.MethodGet, "/v1/oidc/callback", app.oidcCallbackHandler) // Exchange the authorization code for an authentication token
+	}
+
+	// OAuth2 authorization server for third-party applications
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/clients", app.requireActivatedUser(app.createOAuthClientHandler))           // Register a third-party application
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/clients", app.requireActivatedUser(app.listOAuthClientsHandler))             // List the current user's applications
+	router.HandlerFunc(http.MethodDelete, "/v1/oauth/clients/:id", app.requireActivatedUser(app.deleteOAuthClientHandler))     // Delete an application and revoke its tokens
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/authorize", app.requireActivatedUser(app.showOAuthAuthorizationHandler))     // Describe an authorization request for the consent screen
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/authorize", app.requireActivatedUser(app.approveOAuthAuthorizationHandler)) // Approve or deny an authorization request
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/token", app.createOAuthTokenHandler)                                        // Issue an access token to a client
+
+	// Administration
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))                            // List and search users
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))                         // Show a user and their permissions
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePermission("users:admin", app.updateUserHandler))                     // Activate or deactivate a user
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.grantPermissionsHandler))    // Grant permissions
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.revokePermissionsHandler)) // Revoke permissions
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("users:admin", app.assignRolesHandler))               // Assign roles
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles", app.requirePermission("users:admin", app.removeRolesHandler))             // Remove roles
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/logout", app.requirePermission("users:admin", app.logoutUserHandler))               // Revoke all authentication tokens
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lockout", app.requirePermission("users:admin", app.unlockUserHandler))            // Clear a login lockout
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("users:admin", app.listRolesHandler))                            // List roles and the permissions they grant
+	router.HandlerFunc(http.MethodPost, "/v1/admin/invitations", app.requirePermission("users:admin", app.createInvitationHandler))              // Invite someone to register
+	router.HandlerFunc(http.MethodGet, "/v1/admin/invitations", app.requirePermission("users:admin", app.listInvitationsHandler))                // List outstanding invitations
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/invitations/:id", app.requirePermission("users:admin", app.deleteInvitationHandler))        // Revoke an invitation
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit-log", app.requirePermission("users:admin", app.listAuditLogHandler))                     // List audited administrative actions
+
+	// The metrics are served here unless they have a listener of their own.
+	if app.config.metrics.addr == "" {
+		router.Handler(http.MethodGet, "/v1/metrics", expvar.Handler())
+		router.Handler(http.MethodGet, "/metrics", promhttp.Handler())
+	}
 
-	router.Handler(http.MethodGet, "/v1/metrics", expvar.Handler())
+	// Wrap the router with the panic recovery middleware.
+	return app.requestID(app.realIP(app.trace(app.metrics(app.recoverPanic(app.compress(app.enableCORS(app.rateLimitIP(app.authenticate(app.rateLimit(router))))))))))
+}
 
+// The metricsRoutes() method returns the handler for the internal metrics listener set
+// by -metrics-addr, which serves the expvar and Prometheus metrics and nothing else.
+func (app *application) metricsRoutes() http.Handler {
+	router := httprouter.New()
+
+	router.Handler(http.MethodGet, "/v1/metrics", expvar.Handler())
 	router.Handler(http.MethodGet, "/metrics", promhttp.Handler())
 
-	// Wrap the router with the panic recovery middleware.
-	return app.metrics(app.measureDuration(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))))
+	return router
 }
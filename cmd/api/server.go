@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -18,6 +19,31 @@ func (app *application) serve() error {
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+	}
+
+	// If -metrics-addr is set, serve the metrics on their own listener, so that they
+	// can be kept off the public network.
+	var metricsSrv *http.Server
+
+	if app.config.metrics.addr != "" {
+		metricsSrv = &http.Server{
+			Addr:         app.config.metrics.addr,
+			Handler:      app.metricsRoutes(),
+			IdleTimeout:  time.Minute,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+		}
+
+		go func() {
+			app.logger.Info("starting metrics server", "addr", metricsSrv.Addr)
+
+			err := metricsSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.Error("metrics server failed", "addr", metricsSrv.Addr, "error", err.Error())
+			}
+		}()
 	}
 
 	// Create a shutdownError channel. We will use this to receive any errors returned
@@ -34,18 +60,43 @@ func (app *application) serve() error {
 		s := <-quit
 
 		// Log a message to say that the signal has been caught.
-		app.logger.Printf("shutting down server due to recieved signal: %s", s.String())
+		app.logger.Info("shutting down server", "signal", s.String())
 
 		// Create a context with a 5-second timeout.
 		ctx, cancel := context.WithTimeout(context.Background(),
 			5*time.Second)
 		defer cancel()
 
-		shutdownError <- srv.Shutdown(ctx)
+		// Call Shutdown() on the server, only sending on the shutdownError channel if it
+		// returns an error. Otherwise we carry on and wait for the background tasks.
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			shutdownError <- err
+			return
+		}
 
-		// Log a message to say that the signal has been caught.
-		app.logger.Printf("Completing background tasks...")
+		if metricsSrv != nil {
+			err = metricsSrv.Shutdown(ctx)
+			if err != nil {
+				shutdownError <- err
+				return
+			}
+		}
+
+		// Stop the sweeper and wait for any background tasks to complete.
+		app.logger.Info("completing background tasks", "addr", srv.Addr)
+		close(app.shutdown)
 		app.wg.Wait()
+
+		// Nothing else writes to the access log now.
+		if app.accessLogFile != nil {
+			err = app.accessLogFile.Close()
+			if err != nil {
+				shutdownError <- err
+				return
+			}
+		}
+
 		shutdownError <- nil
 
 	}()
@@ -59,7 +110,7 @@ func (app *application) serve() error {
 	if err != nil {
 		return err
 	}
-	app.logger.Printf("stopped server on addr: %s", srv.Addr)
+	app.logger.Info("stopped server", "addr", srv.Addr)
 	// Start the server as normal, returning any error.
 	return nil
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/codes"
+	"greenlight.mpdev.com/internal/ratelimit"
+)
+
+var (
+	sweeperRemoved = expvar.NewMap("sweeper_removed")
+
+	promSweeperRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "go_metrics",
+		Subsystem: "prometheus",
+		Name:      "sweeper_removed_total",
+		Help:      "Rows removed by the background sweeper, by kind.",
+	}, []string{"kind"})
+)
+
+// Define a sweepTask type for each kind of row the sweeper removes. The sweep function
+// removes at most batchSize rows and returns how many it removed.
+type sweepTask struct {
+	kind  string
+	sweep func(ctx context.Context, batchSize int) (int64, error)
+}
+
+// The sweepTasks() method returns the tasks run on each pass of the sweeper.
+func (app *application) sweepTasks() []sweepTask {
+	tasks := []sweepTask{
+		{"expired_tokens", app.models.Tokens.DeleteExpired},
+		{"expired_oidc_logins", app.models.OIDCLogins.DeleteExpired},
+		{"expired_oauth_codes", app.models.OAuthCodes.DeleteExpired},
+		{"expired_invitations", app.models.Invitations.DeleteExpired},
+		{"expired_idempotency_keys", app.models.Idempotency.DeleteExpired},
+		{"deleted_users", func(ctx context.Context, batchSize int) (int64, error) {
+			return app.models.Users.PurgeDeleted(ctx, time.Now().Add(-app.config.users.deletionGracePeriod), batchSize)
+		}},
+	}
+
+	// Buckets which have been idle this long have refilled completely, unless the rate
+	// is very low, and a missing bucket counts as a full one.
+	if store, ok := app.limiter.(*ratelimit.PostgresStore); ok {
+		tasks = append(tasks, sweepTask{"idle_rate_limit_buckets", func(ctx context.Context, batchSize int) (int64, error) {
+			return store.DeleteIdle(ctx, time.Now().Add(-time.Hour), batchSize)
+		}})
+	}
+
+	if app.config.users.unactivatedRetention > 0 {
+		tasks = append(tasks, sweepTask{"unactivated_users", func(ctx context.Context, batchSize int) (int64, error) {
+			return app.models.Users.PurgeUnactivated(ctx, time.Now().Add(-app.config.users.unactivatedRetention), batchSize)
+		}})
+	}
+
+	return tasks
+}
+
+// The startSweeper() method launches a background goroutine which periodically deletes
+// expired tokens and other expired rows, and purges deleted and never-activated
+// accounts. Rows are deleted in batches so that no single statement holds locks on a
+// large number of rows. The sweeper is tracked by app.wg and stops when app.shutdown is
+// closed, finishing the batch it is working on first.
+func (app *application) startSweeper() {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(app.config.sweeper.interval)
+		defer ticker.Stop()
+
+		for {
+			app.sweep()
+
+			select {
+			case <-ticker.C:
+			case <-app.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// The sweep() method runs each task until it has nothing left to remove, or until the
+// application starts shutting down.
+func (app *application) sweep() {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.Error("sweeper failed", "error", fmt.Sprintf("%v", err))
+		}
+	}()
+
+	ctx, span := tracer.Start(context.Background(), "sweeper")
+	defer span.End()
+
+	for _, task := range app.sweepTasks() {
+		var total int64
+
+		for {
+			removed, err := app.sweepBatch(ctx, task)
+			if err != nil {
+				app.logger.ErrorContext(ctx, "sweeper failed", "kind", task.kind, "error", err.Error())
+				break
+			}
+
+			total += removed
+
+			if removed < int64(app.config.sweeper.batchSize) || app.shuttingDown() {
+				break
+			}
+		}
+
+		if total > 0 {
+			sweeperRemoved.Add(task.kind, total)
+			promSweeperRemoved.WithLabelValues(task.kind).Add(float64(total))
+			app.logger.InfoContext(ctx, "sweeper removed records", "kind", task.kind, "count", total)
+		}
+
+		if app.shuttingDown() {
+			return
+		}
+	}
+}
+
+// The sweepBatch() method runs one batch of a task in its own span.
+func (app *application) sweepBatch(ctx context.Context, task sweepTask) (int64, error) {
+	ctx, span := tracer.Start(ctx, "sweep "+task.kind)
+	defer span.End()
+
+	removed, err := task.sweep(ctx, app.config.sweeper.batchSize)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return removed, err
+}
+
+// The shuttingDown() method reports whether app.shutdown has been closed.
+func (app *application) shuttingDown() bool {
+	select {
+	case <-app.shutdown:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"net/http"
 	"time"
 
@@ -30,7 +30,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	}
 
 	// Try to retrieve the corresponding user record for the email address.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case err.Error() == pgx.ErrNoRows.Error():
@@ -49,8 +49,19 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
+	deactivated, err := app.deactivated(r.Context(), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if deactivated {
+		app.accountDeactivatedResponse(w, r)
+		return
+	}
+
 	// Otherwise, create a new activation token.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -58,26 +69,24 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	}
 
 	// Email the user with their additional activation token.
-	app.background(func() {
+	app.background(r.Context(), "send activation email", func(ctx context.Context) {
 		data := map[string]interface{}{
 			"activationToken": token.Plaintext,
 		}
 
-		// remove the below line in production
-		fmt.Printf("Token %s\n", token.Plaintext)
 		// Since email addresses MAY be case sensitive, notice that we are sending this
 		// email using the address stored in our database for the user ---  not to the
 		// input.Email address provided by the client in this request.
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
+		err = app.mailer.Send(ctx, user.Email, "token_activation.tmpl", data)
 		if err != nil {
-			app.logger.Printf(err.Error(), nil)
+			app.logger.ErrorContext(ctx, err.Error())
 		}
 	})
 
 	// Send the 202 Accepted response and confirmation message to the client.
 	env := envelope{"message": "an email will be sent to you containing activation instructions"}
 
-	err = app.writeJSON(w, http.StatusAccepted, env, nil, r)
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -108,7 +117,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	// Try to retrieve the corresponding user record for the email address.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case err.Error() == pgx.ErrNoRows.Error():
@@ -121,6 +130,13 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// Refuse to even check the password while the account is backing off from earlier
+	// failures or is locked out.
+	attempt, ok := app.reserveLoginAttempt(w, r, user)
+	if !ok {
+		return
+	}
+
 	// Check if the provided password matches the actual password for the user.
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
@@ -129,12 +145,85 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	if !match {
+		err = app.recordFailedLogin(r, user, attempt)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// The password was right, so this attempt doesn't count. completeLogin() resets the
+	// counter once the user has presented every factor.
+	err = app.models.LoginAttempts.Release(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Now that we have the plaintext password and know it is correct, upgrade the hash
+	// if it was made with bcrypt or with weaker parameters than we currently use. This
+	// is best effort, so a failure is logged rather than failing the login.
+	if user.Password.NeedsRehash() {
+		err = app.rehashPassword(r.Context(), user, input.Password)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// The rehashPassword() helper hashes the password with the current parameters and
+// saves it. If the account was changed concurrently the update fails with an edit
+// conflict and the old hash is kept until the next login.
+func (app *application) rehashPassword(ctx context.Context, user *data.User, plaintextPassword string) error {
+	err := user.Password.Set(plaintextPassword)
+	if err != nil {
+		return err
+	}
+
+	return app.models.Users.Update(ctx, user)
+}
+
+// The completeLogin() helper is called once a user has proven their primary
+// credentials. If two-factor authentication is enabled for the account we respond with
+// a short-lived challenge token, which must be exchanged for an authentication token at
+// POST /v1/tokens/two-factor. Otherwise we issue the authentication token directly.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	enabled, err := app.models.TOTP.IsEnabled(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The user still has to present a second factor, so keep the failed attempt counter
+	// until they do.
+	if enabled {
+		challenge, err := app.models.Tokens.New(r.Context(), user.ID, 5*time.Minute, data.ScopeTwoFactor)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env := envelope{"two_factor_challenge": challenge}
+
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.LoginAttempts.Reset(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Otherwise, we generate a new token with a 24-hour expiry time and the scope 'authentication'.
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
 
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -143,7 +232,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	env := envelope{"authentication_token": token}
 
-	err = app.writeJSON(w, http.StatusCreated, env, nil, r)
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/jackc/pgx/v5"
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the application's spans. Until setupTracing() installs a tracer
+// provider it uses OpenTelemetry's no-op provider, so spans cost next to nothing.
+var tracer = otel.Tracer("greenlight.mpdev.com/cmd/api")
+
+// The setupTracing() helper installs the W3C Trace Context and Baggage propagators and,
+// if -otel-endpoint is set, a tracer provider which exports spans over OTLP/HTTP to a
+// collector there. It returns a function which flushes any buffered spans on shutdown.
+func setupTracing(cfg config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if cfg.otel.endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(cfg.otel.endpoint)}
+	if strings.HasPrefix(cfg.otel.endpoint, "http://") {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("greenlight"),
+		semconv.ServiceVersion(version),
+		semconv.DeploymentEnvironment(cfg.env),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.otel.sampleRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// The trace() middleware starts a server span for each request, continuing the trace
+// from the client's traceparent header if there is one. The span is named after the
+// method alone until the router has matched a route; see route().
+func (app *application) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(app.contextGetClientIP(r)),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			),
+		)
+		defer span.End()
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(metrics.Code))
+		if metrics.Code >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(metrics.Code))
+		}
+	})
+}
+
+// Define an appRouter type to register our routes with httprouter, recording the
+// pattern of the matched route for the request's span and for the outer middleware. It
+// has the same HandlerFunc() and Handler() methods as httprouter.Router.
+type appRouter struct {
+	*httprouter.Router
+	app *application
+}
+
+func (rt appRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rt.Handler(method, path, handler)
+}
+
+func (rt appRouter) Handler(method, path string, handler http.Handler) {
+	rt.Router.Handler(method, path, rt.app.route(method, path, handler))
+}
+
+// The route() middleware records the pattern of the route which matched the request.
+func (app *application) route(method, pattern string, next http.Handler) http.Handler {
+	name := method + " " + pattern
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(name)
+		span.SetAttributes(semconv.HTTPRoute(pattern))
+
+		if info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo); ok {
+			info.route = pattern
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Define a queryTracer type to trace each query made through pgx, as a child of the
+// span in the query's context. Queries made without a span, like the sweeper's, are
+// only traced when the sweeper starts one.
+type queryTracer struct{}
+
+func (queryTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		return ctx
+	}
+
+	ctx, _ = tracer.Start(ctx, queryName(data.SQL),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBQueryText(data.SQL),
+		),
+	)
+
+	return ctx
+}
+
+func (queryTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := trace.SpanFromContext(ctx)
+
+	if data.Err != nil && !errors.Is(data.Err, pgx.ErrNoRows) {
+		span.RecordError(data.Err)
+		span.SetStatus(codes.Error, data.Err.Error())
+	}
+
+	span.End()
+}
+
+// The queryName() helper names a query's span after its first keyword and table, like
+// "SELECT users", which is enough to tell the queries in a trace apart.
+func queryName(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return "query"
+	}
+
+	operation := strings.ToUpper(fields[0])
+
+	for i, field := range fields[:len(fields)-1] {
+		switch strings.ToUpper(field) {
+		case "FROM", "INTO", "UPDATE":
+			if operation == "SELECT" || operation == "DELETE" || operation == "INSERT" || operation == "UPDATE" || operation == "WITH" {
+				return operation + " " + strings.Trim(fields[i+1], "(),")
+			}
+		}
+	}
+
+	return operation
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx"
@@ -17,6 +19,8 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Name     string `json:"name"`
 		Email    string `json:"email"`
 		Password string `json:"password"`
+
+		InvitationToken string `json:"invitation_token"`
 	}
 
 	// Parse the request body into the anonymous struct.
@@ -41,12 +45,47 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	// Initialize a new Validator instance.
 	v := validator.New()
 
+	if app.config.registration.inviteOnly {
+		v.Check(input.InvitationToken != "", "invitation_token", "must be provided")
+	}
+
 	if data.ValidateUser(v, user); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Users.Insert(user)
+	// Users who were invited are activated straight away, since the invitation was
+	// sent to their email address.
+	if input.InvitationToken != "" {
+		if !app.checkInvitation(w, r, v, input.InvitationToken, user.Email) {
+			return
+		}
+
+		_, err = app.models.Invitations.Redeem(r.Context(), input.InvitationToken, user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrDuplicateEmail):
+				v.AddError("email", "a user with this email address already exists")
+				app.failedValidationResponse(w, r, v.Errors)
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("invitation_token", "invalid or expired invitation token")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.permissions.Invalidate(user.ID)
+
+		err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Users.Insert(r.Context(), user)
 	if err != nil {
 		switch {
 
@@ -62,12 +101,12 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Add the "movies:read" permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	err = app.models.Permissions.AddForUser(r.Context(), user.ID, "movies:read")
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -75,28 +114,51 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// create goroutine to send the welcome email in the background
-	app.background(func() {
+	app.background(r.Context(), "send welcome email", func(ctx context.Context) {
 
 		data := map[string]interface{}{
 			"activationToken": token.Plaintext,
 			"userID":          user.ID,
 		}
 
-		// remove the below line in production
-		fmt.Printf("Token %s\n", token.Plaintext)
-
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		err = app.mailer.Send(ctx, user.Email, "user_welcome.tmpl", data)
 		if err != nil {
-			app.logger.Printf(err.Error(), nil)
+			app.logger.ErrorContext(ctx, err.Error())
 		}
 	})
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil, r)
+	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// The checkInvitation() helper checks that the invitation token is valid and was sent
+// to the email address being registered. The invitation is only used up once the user
+// has been registered with it. If the invitation can't be redeemed it sends a 422
+// Unprocessable Entity response and returns false.
+func (app *application) checkInvitation(w http.ResponseWriter, r *http.Request, v *validator.Validator, tokenPlaintext, email string) bool {
+	invitation, err := app.models.Invitations.GetForToken(r.Context(), tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("invitation_token", "invalid or expired invitation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	if !strings.EqualFold(invitation.Email, email) {
+		v.AddError("email", "must be the address the invitation was sent to")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	return true
+}
+
 func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the plaintext activation token from the request body.
 	var input struct {
@@ -116,7 +178,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Retrieve the details of the user associated with the token
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case err.Error() == pgx.ErrNoRows.Error():
@@ -128,11 +190,24 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Tokens issued before an administrator deactivated the account were revoked then,
+	// but refuse anyway, since only an administrator may reactivate it.
+	deactivated, err := app.deactivated(r.Context(), user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if deactivated {
+		app.accountDeactivatedResponse(w, r)
+		return
+	}
+
 	// Update the user's activation status.
 	user.Activated = true
 
 	// Save the updated user record in our database
-	err = app.models.Users.Update(user)
+	err = app.models.Users.Update(r.Context(), user)
 	if err != nil {
 		switch {
 		case err.Error() == data.ErrEditConflict.Error():
@@ -144,16 +219,322 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// If everything went successfully, then we delete all activation tokens for the user
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 	// Send the updated user details to the client in a JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil, r)
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+}
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// Use pointers so that we can tell which fields were included in the request body.
+	var input struct {
+		Name            *string `json:"name"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Name == nil && input.Email == nil && input.Password == nil {
+		v.AddError("user", "must contain at least one of name, email or password")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Changing the email address or password hands over control of the account, so
+	// make the caller prove they know the password and not just hold a token.
+	sensitive := input.Email != nil || input.Password != nil
+
+	if sensitive {
+		v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	}
+
+	if input.Email != nil {
+		data.ValidateEmail(v, *input.Email)
+		v.Check(!strings.EqualFold(*input.Email, user.Email), "email", "must be different from the current email address")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if sensitive && !app.verifyCurrentPassword(w, r, user, input.CurrentPassword) {
+		return
+	}
+
+	// Fail early if the new address is already taken. This is checked again when the
+	// change is confirmed, since somebody could register the address in the meantime.
+	if input.Email != nil {
+		_, err = app.models.Users.GetByEmail(r.Context(), *input.Email)
+		switch {
+		case err == nil:
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		case !errors.Is(err, data.ErrRecordNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if input.Password != nil {
+		err = user.Password.Set(*input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.Name != nil || input.Password != nil {
+		err = app.models.Users.Update(r.Context(), user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	// A new password signs the user out everywhere, including this session, in case the
+	// old password was compromised.
+	if input.Password != nil {
+		err = app.models.Tokens.DeleteAllScopesForUser(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env := envelope{"user": user}
+	status := http.StatusOK
+
+	// The email address itself is only changed once the new address has been confirmed.
+	if input.Email != nil {
+		err = app.requestEmailChange(r, user, *input.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env["message"] = "an email will be sent to the new address containing confirmation instructions"
+		status = http.StatusAccepted
+	}
+
+	err = app.writeJSON(w, status, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
+}
 
+// The requestEmailChange() helper records a pending email change, then emails a
+// confirmation token to the new address and a notice to the old one.
+func (app *application) requestEmailChange(r *http.Request, user *data.User, newEmail string) error {
+	err := app.models.EmailChanges.Insert(r.Context(), user.ID, newEmail)
+	if err != nil {
+		return err
+	}
+
+	// Only the most recently requested change can be confirmed.
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeEmailChange, user.ID)
+	if err != nil {
+		return err
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		return err
+	}
+
+	oldEmail := user.Email
+
+	app.background(r.Context(), "send email change emails", func(ctx context.Context) {
+		err := app.mailer.Send(ctx, newEmail, "email_change_confirm.tmpl", map[string]interface{}{
+			"emailChangeToken": token.Plaintext,
+		})
+		if err != nil {
+			app.logger.ErrorContext(ctx, err.Error())
+		}
+
+		err = app.mailer.Send(ctx, oldEmail, "email_change_notice.tmpl", map[string]interface{}{
+			"newEmail": newEmail,
+		})
+		if err != nil {
+			app.logger.ErrorContext(ctx, err.Error())
+		}
+	})
+
+	return nil
+}
+
+// Delete the current user's account. The account is deactivated and signed out
+// everywhere straight away, and the record is purged once the configured grace period
+// has passed.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.CurrentPassword != "", "current_password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.verifyCurrentPassword(w, r, user, input.CurrentPassword) {
+		return
+	}
+
+	err = app.models.Users.Delete(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllScopesForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.EmailChanges.Delete(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	purgeAt := time.Now().Add(app.config.users.deletionGracePeriod)
+
+	env := envelope{"message": fmt.Sprintf("your account has been deactivated and will be permanently deleted after %s", purgeAt.UTC().Format(time.RFC1123))}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	newEmail, err := app.models.EmailChanges.Get(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.Email = newEmail
+
+	err = app.models.Users.Update(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.EmailChanges.Delete(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
@@ -0,0 +1,129 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Define a RotatingFile type to write to a file which is rotated once it would grow
+// beyond maxSize bytes. The current file is renamed with a ".1" suffix, older files
+// move up one number, and only maxBackups old files are kept.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens the file at path for appending, creating it if necessary.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, size, err := openAppend(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.file = file
+	f.size = size
+
+	return nil
+}
+
+func openAppend(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+// Write appends p to the file, rotating it first if p would take it over the maximum
+// size. If the rotation fails p is still written, to the file we already have, and the
+// rotation is tried again on the next write.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var rotateErr error
+
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		rotateErr = f.rotate()
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	if err == nil && rotateErr != nil {
+		err = fmt.Errorf("rotating %s: %w", f.path, rotateErr)
+	}
+
+	return n, err
+}
+
+// The rotate() method moves the current file out of the way and starts a new one. The
+// current file stays open until the new one has been opened, so if anything fails we
+// carry on writing to it, even if it has already been renamed, rather than losing every
+// later line.
+func (f *RotatingFile) rotate() error {
+	if f.maxBackups < 1 {
+		err := os.Remove(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		err := os.Rename(f.path, f.path+".1")
+		if err != nil {
+			return err
+		}
+	}
+
+	file, size, err := openAppend(f.path)
+	if err != nil {
+		return err
+	}
+
+	old := f.file
+	f.file = file
+	f.size = size
+
+	return old.Close()
+}
+
+// Close closes the file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
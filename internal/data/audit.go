@@ -0,0 +1,112 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Define constants for the audited actions.
+const (
+	AuditUserActivated      = "user.activated"
+	AuditUserDeactivated    = "user.deactivated"
+	AuditUserUnlocked       = "user.unlocked"
+	AuditUserLoggedOut      = "user.logged_out"
+	AuditPermissionsGranted = "permissions.granted"
+	AuditPermissionsRevoked = "permissions.revoked"
+	AuditRolesAssigned      = "roles.assigned"
+	AuditRolesRemoved       = "roles.removed"
+	AuditInvitationCreated  = "invitation.created"
+	AuditInvitationRevoked  = "invitation.revoked"
+)
+
+// Define an AuditEntry struct to record an administrative action. ActorID and
+// TargetUserID are nil once the corresponding user has been purged. IP is the address
+// of the client the action came from, which is empty for older entries.
+type AuditEntry struct {
+	ID           int64          `json:"id"`
+	CreatedAt    time.Time      `json:"created_at"`
+	ActorID      *int64         `json:"actor_id"`
+	Action       string         `json:"action"`
+	TargetUserID *int64         `json:"target_user_id"`
+	Details      map[string]any `json:"details,omitempty"`
+	IP           string         `json:"ip,omitempty"`
+}
+
+// Define the AuditModel type.
+type AuditModel struct {
+	DB DBTX
+}
+
+// Insert() adds a new entry to the audit log.
+func (m AuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	if entry.Details == nil {
+		entry.Details = map[string]any{}
+	}
+
+	query := `
+	INSERT INTO audit_log (actor_id, action, target_user_id, details, ip)
+	VALUES ($1, $2, $3, $4, NULLIF($5, '')::inet)
+	RETURNING id, created_at`
+
+	args := []interface{}{entry.ActorID, entry.Action, entry.TargetUserID, entry.Details, entry.IP}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+// GetAll() returns a page of audit log entries, optionally filtered by action and by
+// the user the action was performed on.
+func (m AuditModel) GetAll(ctx context.Context, action string, targetUserID int64, filters Filters) ([]*AuditEntry, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), id, created_at, actor_id, action, target_user_id, details, COALESCE(host(ip), '')
+	FROM audit_log
+	WHERE (action = $1 OR $1 = '')
+	AND (target_user_id = $2 OR $2 = 0)
+	ORDER BY %s %s, id DESC
+	LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{action, targetUserID, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+
+	for rows.Next() {
+		var entry AuditEntry
+
+		err := rows.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.ActorID,
+			&entry.Action,
+			&entry.TargetUserID,
+			&entry.Details,
+			&entry.IP,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return entries, metadata, nil
+}
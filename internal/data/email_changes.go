@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Define the EmailChangeModel type. It holds the new address for a pending email
+// change until the user confirms it with the token sent to that address.
+type EmailChangeModel struct {
+	DB DBTX
+}
+
+// Insert() records a pending email change for the user, replacing any earlier request.
+func (m EmailChangeModel) Insert(ctx context.Context, userID int64, newEmail string) error {
+	query := `
+	INSERT INTO email_changes (user_id, new_email)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET created_at = NOW(), new_email = EXCLUDED.new_email`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID, newEmail)
+	return err
+}
+
+// Get() returns the pending new email address for the user.
+func (m EmailChangeModel) Get(ctx context.Context, userID int64) (string, error) {
+	query := `
+	SELECT new_email
+	FROM email_changes
+	WHERE user_id = $1`
+
+	var newEmail string
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, userID).Scan(&newEmail)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	return newEmail, nil
+}
+
+// Delete() removes the pending email change for the user.
+func (m EmailChangeModel) Delete(ctx context.Context, userID int64) error {
+	query := `
+	DELETE FROM email_changes
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Define an IdempotencyKey struct to hold a key sent by a client in an Idempotency-Key
+// header, along with a fingerprint of the request it was first used for and, once that
+// request has been handled, the response to replay. Keys are scoped to whoever sent
+// them, so that one client can never be sent another's response; the scope is chosen
+// by the caller. A Status of 0 means the first request is still being handled.
+type IdempotencyKey struct {
+	Scope       string
+	Key         string
+	Fingerprint []byte
+	Status      int
+	Header      http.Header
+	Body        []byte
+	Expiry      time.Time
+}
+
+// Define the IdempotencyKeyModel type.
+type IdempotencyKeyModel struct {
+	DB DBTX
+}
+
+// Claim() records a new key, with no response yet, and returns true. It returns false
+// if the key is already in use. An expired key which the sweeper hasn't removed yet is
+// claimed afresh, as if it was new.
+func (m IdempotencyKeyModel) Claim(ctx context.Context, key *IdempotencyKey) (bool, error) {
+	query := `
+	INSERT INTO idempotency_keys (scope, key, fingerprint, expiry)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (scope, key) DO UPDATE
+	SET fingerprint = EXCLUDED.fingerprint, status = NULL, header = NULL, body = NULL, expiry = EXCLUDED.expiry
+	WHERE idempotency_keys.expiry < NOW()`
+
+	args := []interface{}{key.Scope, key.Key, key.Fingerprint, key.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	return result.RowsAffected() == 1, nil
+}
+
+// Get() returns the key in the given scope. It returns ErrRecordNotFound if there isn't
+// one, or if it has expired.
+func (m IdempotencyKeyModel) Get(ctx context.Context, scope, key string) (*IdempotencyKey, error) {
+	query := `
+	SELECT fingerprint, COALESCE(status, 0), COALESCE(header, '{}'), COALESCE(body, ''), expiry
+	FROM idempotency_keys
+	WHERE scope = $1 AND key = $2 AND expiry > NOW()`
+
+	k := IdempotencyKey{Scope: scope, Key: key}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, scope, key).Scan(&k.Fingerprint, &k.Status, &k.Header, &k.Body, &k.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &k, nil
+}
+
+// Complete() stores the response to the request a key was claimed for.
+func (m IdempotencyKeyModel) Complete(ctx context.Context, key *IdempotencyKey) error {
+	query := `
+	UPDATE idempotency_keys
+	SET status = $1, header = $2, body = $3
+	WHERE scope = $4 AND key = $5`
+
+	args := []interface{}{key.Status, key.Header, key.Body, key.Scope, key.Key}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, args...)
+	return err
+}
+
+// Delete() releases a key, so that the request can be retried with it.
+func (m IdempotencyKeyModel) Delete(ctx context.Context, scope, key string) error {
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE scope = $1 AND key = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, scope, key)
+	return err
+}
+
+// DeleteExpired() deletes up to batchSize keys which have expired.
+func (m IdempotencyKeyModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE (scope, key) IN (
+		SELECT scope, key FROM idempotency_keys
+		WHERE expiry < NOW()
+		LIMIT $1
+	)`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
@@ -0,0 +1,257 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"greenlight.mpdev.com/internal/validator"
+)
+
+// Define an Invitation struct to hold an invitation to register, created by an
+// administrator. Whoever redeems it must register with the invited email address, and
+// their account is activated straight away with the given permissions. Like tokens,
+// only a hash of the invitation token is stored.
+type Invitation struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Plaintext   string    `json:"-"`
+	Email       string    `json:"email"`
+	Permissions []string  `json:"permissions"`
+	InvitedBy   *int64    `json:"invited_by"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// MaxInvitationTTL is the longest an invitation may remain valid for.
+const MaxInvitationTTL = 30 * 24 * time.Hour
+
+func ValidateInvitation(v *validator.Validator, invitation *Invitation, known Permissions) {
+	ValidateEmail(v, invitation.Email)
+	ValidatePermissionCodes(v, invitation.Permissions, known)
+
+	v.Check(invitation.Expiry.After(time.Now()), "expiry", "must be in the future")
+	v.Check(invitation.Expiry.Before(time.Now().Add(MaxInvitationTTL)), "expiry", "must not be more than 30 days in the future")
+}
+
+// Define the InvitationModel type.
+type InvitationModel struct {
+	DB DBTX
+}
+
+// Insert() generates the invitation token and stores the invitation. The plaintext
+// token is left in invitation.Plaintext to be emailed to the invitee.
+func (m InvitationModel) Insert(ctx context.Context, invitation *Invitation) error {
+	var err error
+
+	invitation.Plaintext, err = generateCredential()
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256([]byte(invitation.Plaintext))
+
+	query := `
+	INSERT INTO invitations (hash, email, permissions, invited_by, expiry)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at`
+
+	args := []interface{}{hash[:], invitation.Email, invitation.Permissions, invitation.InvitedBy, invitation.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// GetForToken() returns the unexpired invitation for the given token.
+func (m InvitationModel) GetForToken(ctx context.Context, tokenPlaintext string) (*Invitation, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	SELECT id, created_at, email, permissions, invited_by, expiry
+	FROM invitations
+	WHERE hash = $1 AND expiry > $2`
+
+	return m.scanOne(ctx, query, hash[:], time.Now())
+}
+
+// Redeem() registers the user with the invitation for the given token, in a single
+// transaction: the user is inserted and activated, the invitation is deleted, and the
+// user is granted the invitation's permissions, so that the invitation is only used up
+// if the account is created in full. It returns ErrDuplicateEmail if the address is already registered,
+// or ErrRecordNotFound if the invitation has expired or was redeemed in the meantime,
+// and in either case leaves the invitation and the users table as they were.
+func (m InvitationModel) Redeem(ctx context.Context, tokenPlaintext string, user *User) (*Invitation, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	user.Activated = true
+
+	err = tx.QueryRow(ctx, `
+	INSERT INTO users (name, email, password_hash, activated, activated_at)
+	VALUES ($1, $2, $3, true, NOW())
+	RETURNING id, created_at, version`, user.Name, user.Email, user.Password.hash).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case isDuplicateEmail(err):
+			return nil, ErrDuplicateEmail
+		default:
+			return nil, err
+		}
+	}
+
+	var invitation Invitation
+
+	err = tx.QueryRow(ctx, `
+	DELETE FROM invitations
+	WHERE hash = $1 AND expiry > $2
+	RETURNING id, created_at, email, permissions, invited_by, expiry`, hash[:], time.Now()).Scan(
+		&invitation.ID,
+		&invitation.CreatedAt,
+		&invitation.Email,
+		&invitation.Permissions,
+		&invitation.InvitedBy,
+		&invitation.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+	INSERT INTO users_permissions
+	SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+	ON CONFLICT DO NOTHING`, user.ID, invitation.Permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &invitation, tx.Commit(ctx)
+}
+
+func (m InvitationModel) scanOne(ctx context.Context, query string, args ...interface{}) (*Invitation, error) {
+	var invitation Invitation
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(
+		&invitation.ID,
+		&invitation.CreatedAt,
+		&invitation.Email,
+		&invitation.Permissions,
+		&invitation.InvitedBy,
+		&invitation.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
+
+// GetAll() returns the outstanding invitations, newest first.
+func (m InvitationModel) GetAll(ctx context.Context) ([]*Invitation, error) {
+	query := `
+	SELECT id, created_at, email, permissions, invited_by, expiry
+	FROM invitations
+	WHERE expiry > NOW()
+	ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []*Invitation{}
+
+	for rows.Next() {
+		var invitation Invitation
+
+		err := rows.Scan(
+			&invitation.ID,
+			&invitation.CreatedAt,
+			&invitation.Email,
+			&invitation.Permissions,
+			&invitation.InvitedBy,
+			&invitation.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		invitations = append(invitations, &invitation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// Delete() revokes an invitation.
+func (m InvitationModel) Delete(ctx context.Context, id int64) error {
+	query := `
+	DELETE FROM invitations
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteExpired() deletes up to batchSize invitations which expired without being
+// redeemed.
+func (m InvitationModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	query := `
+	DELETE FROM invitations
+	WHERE id IN (
+		SELECT id FROM invitations
+		WHERE expiry < NOW()
+		LIMIT $1
+	)`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Define a LoginAttempt struct to track consecutive failed logins for a user.
+type LoginAttempt struct {
+	UserID       int64
+	FailedCount  int
+	LastFailedAt time.Time
+	LockedUntil  *time.Time
+}
+
+// Locked reports whether the account is locked out at the given time.
+func (a *LoginAttempt) Locked(t time.Time) bool {
+	return a.LockedUntil != nil && a.LockedUntil.After(t)
+}
+
+// Define the LoginAttemptModel type.
+type LoginAttemptModel struct {
+	DB DBTX
+}
+
+// Get() returns the failed login state for a user. Users without any recorded failures
+// get a zero-valued LoginAttempt rather than an error.
+func (m LoginAttemptModel) Get(ctx context.Context, userID int64) (*LoginAttempt, error) {
+	query := `
+	SELECT user_id, failed_count, last_failed_at, locked_until
+	FROM login_attempts
+	WHERE user_id = $1`
+
+	attempt := LoginAttempt{UserID: userID}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, userID).Scan(
+		&attempt.UserID,
+		&attempt.FailedCount,
+		&attempt.LastFailedAt,
+		&attempt.LockedUntil,
+	)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// Reserve() atomically counts an attempt against the user as a failure, before their
+// credentials have been checked, and returns the updated state. It returns false
+// instead if the user is locked out, or if less time has passed since their last
+// failure than the backoff, which starts at backoff and doubles with each consecutive
+// failure up to lockout. Because the attempt is counted before the slow password hash
+// is checked, concurrent guesses can't all slip through on the same counter value.
+func (m LoginAttemptModel) Reserve(ctx context.Context, userID int64, backoff, lockout time.Duration) (*LoginAttempt, bool, error) {
+	query := `
+	INSERT INTO login_attempts (user_id, failed_count, last_failed_at)
+	VALUES ($1, 1, NOW())
+	ON CONFLICT (user_id) DO UPDATE
+	SET failed_count = login_attempts.failed_count + 1, last_failed_at = NOW()
+	WHERE (login_attempts.locked_until IS NULL OR login_attempts.locked_until <= NOW())
+	AND (login_attempts.failed_count = 0 OR login_attempts.last_failed_at +
+		LEAST($2 * power(2, LEAST(login_attempts.failed_count - 1, 30)), $3) * INTERVAL '1 second' <= NOW())
+	RETURNING user_id, failed_count, last_failed_at, locked_until`
+
+	args := []interface{}{userID, backoff.Seconds(), lockout.Seconds()}
+
+	var attempt LoginAttempt
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(
+		&attempt.UserID,
+		&attempt.FailedCount,
+		&attempt.LastFailedAt,
+		&attempt.LockedUntil,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, false, nil
+		default:
+			return nil, false, err
+		}
+	}
+
+	return &attempt, true, nil
+}
+
+// Release() takes back an attempt counted by Reserve() which turned out to be correct,
+// leaving any earlier failures in place.
+func (m LoginAttemptModel) Release(ctx context.Context, userID int64) error {
+	query := `
+	UPDATE login_attempts
+	SET failed_count = failed_count - 1
+	WHERE user_id = $1 AND failed_count > 0`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
+
+// Lock() locks the user out until the given time.
+func (m LoginAttemptModel) Lock(ctx context.Context, userID int64, until time.Time) error {
+	query := `
+	UPDATE login_attempts
+	SET locked_until = $2
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID, until)
+	return err
+}
+
+// Reset() clears the failed login counter and any lockout for a user.
+func (m LoginAttemptModel) Reset(ctx context.Context, userID int64) error {
+	query := `
+	DELETE FROM login_attempts
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
@@ -1,8 +1,11 @@
 package data
 
 import (
+	"context"
 	"errors"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -13,22 +16,78 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// DBTX is the subset of the methods of a connection pool and a transaction which the
+// models use, so that they can run queries in either.
+type DBTX interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
 // like a UserModel and PermissionModel, as our build progresses.
 type Models struct {
-	Movies      MovieModel
-	Permissions PermissionModel
-	Users       UserModel
-	Tokens      TokenModel
+	Movies        MovieModel
+	Permissions   PermissionModel
+	Users         UserModel
+	Tokens        TokenModel
+	TOTP          TOTPModel
+	Recovery      RecoveryCodeModel
+	LoginAttempts LoginAttemptModel
+	EmailChanges  EmailChangeModel
+	Audit         AuditModel
+	Roles         RoleModel
+	OIDCLogins    OIDCLoginModel
+	OAuthClients  OAuthClientModel
+	OAuthCodes    OAuthCodeModel
+	Invitations   InvitationModel
+	Idempotency   IdempotencyKeyModel
+
+	db DBTX
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
 // the initialized MovieModel.
 func NewModels(db *pgxpool.Pool) Models {
+	return newModels(db)
+}
+
+func newModels(db DBTX) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
+		Movies:        MovieModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		Users:         UserModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		TOTP:          TOTPModel{DB: db},
+		Recovery:      RecoveryCodeModel{DB: db},
+		LoginAttempts: LoginAttemptModel{DB: db},
+		EmailChanges:  EmailChangeModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		Roles:         RoleModel{DB: db},
+		OIDCLogins:    OIDCLoginModel{DB: db},
+		OAuthClients:  OAuthClientModel{DB: db},
+		OAuthCodes:    OAuthCodeModel{DB: db},
+		Invitations:   InvitationModel{DB: db},
+		Idempotency:   IdempotencyKeyModel{DB: db},
+		db:            db,
 	}
 }
+
+// Transaction() calls fn with a copy of the models which run their queries in a single
+// transaction. The transaction is committed if fn returns nil, and rolled back if it
+// returns an error, which Transaction() then returns.
+func (m Models) Transaction(ctx context.Context, fn func(tx Models) error) error {
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = fn(newModels(tx))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
@@ -2,12 +2,11 @@ package data
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
 	"time"
 
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5"
 	"github.com/lib/pq"
 	"greenlight.mpdev.com/internal/validator"
 )
@@ -20,6 +19,7 @@ type Movie struct {
 	Runtime   int32     `json:"runtime,omitempty"` // Add the omitempty directive
 	Genres    []string  `json:"genres,omitempty"`  // Add the omitempty directive
 	Version   int32     `json:"version"`
+	CreatedBy int64     `json:"created_by,omitempty"` // ID of the user who created the movie, 0 if unknown
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -43,19 +43,19 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 
 // Define a MovieModel struct type which wraps a sql.DB connection pool.
 type MovieModel struct {
-	DB *pgxpool.Pool
+	DB DBTX
 }
 
 // Add a placeholder method for inserting a new record in the movies table.
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 
 	query := `
- 		INSERT INTO movies (title, year, runtime, genres) 
- 		VALUES ($1, $2, $3, $4)
+ 		INSERT INTO movies (title, year, runtime, genres, created_by) 
+ 		VALUES ($1, $2, $3, $4, NULLIF($5, 0))
  		RETURNING id, created_at, version`
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
 	defer cancel()
 
@@ -64,7 +64,7 @@ func (m MovieModel) Insert(movie *Movie) error {
 
 // Add a placeholder method for fetching a specific record from the movies table.
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 
 	if id < 1 {
 		return nil, ErrRecordNotFound
@@ -73,19 +73,19 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	var movie Movie
 
 	query := `
- 		SELECT id, created_at, title, year, runtime, genres, version
+ 		SELECT id, created_at, title, year, runtime, genres, version, COALESCE(created_by, 0)
 		FROM movies 
  		WHERE id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
 	defer cancel()
 
-	err := m.DB.QueryRow(ctx, query, id).Scan(&movie.ID, &movie.CreatedAt, &movie.Title, &movie.Year, &movie.Runtime, &movie.Genres, &movie.Version)
+	err := m.DB.QueryRow(ctx, query, id).Scan(&movie.ID, &movie.CreatedAt, &movie.Title, &movie.Year, &movie.Runtime, &movie.Genres, &movie.Version, &movie.CreatedBy)
 
 	if err != nil {
 		switch {
-		case errors.Is(err, sql.ErrNoRows):
+		case errors.Is(err, pgx.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
 			return nil, err
@@ -96,12 +96,12 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
 
 	//Add an ORDER BY clause and interpolate the sort column and direction. Importantly notice that we also include a secondary sort on the movie ID to ensure a consistent ordering.
 
 	query := fmt.Sprintf(`
-					SELECT count(*) OVER(),id, created_at, title, year, runtime, genres, version
+					SELECT count(*) OVER(),id, created_at, title, year, runtime, genres, version, COALESCE(created_by, 0)
 					FROM movies
 					WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1)
    					OR $1 = '') 
@@ -109,7 +109,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 					ORDER BY %s %s, id ASC
 					LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
 	defer cancel()
 
@@ -144,6 +144,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			&movie.Genres,
 			&movie.Version,
+			&movie.CreatedBy,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -166,7 +167,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 }
 
 // Add a placeholder method for updating a specific record in the movies table
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 
 	query := `
  		UPDATE movies 
@@ -185,14 +186,14 @@ func (m MovieModel) Update(movie *Movie) error {
 
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
 	defer cancel()
 
 	err := m.DB.QueryRow(ctx, query, args...).Scan(&movie.Version)
 	if err != nil {
 		switch {
-		case errors.Is(err, sql.ErrNoRows):
+		case errors.Is(err, pgx.ErrNoRows):
 			return ErrEditConflict
 		default:
 			return err
@@ -203,7 +204,7 @@ func (m MovieModel) Update(movie *Movie) error {
 
 // Add a placeholder method for deleting a specific record from the movies table.
 
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -211,7 +212,7 @@ func (m MovieModel) Delete(id int64) error {
 	query := ` 
  		DELETE FROM movies
  		WHERE id = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
 	defer cancel()
 
@@ -0,0 +1,366 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"greenlight.mpdev.com/internal/validator"
+)
+
+// Define an OAuthClient struct to hold a third-party application registered by one of
+// our users. Confidential clients authenticate with a secret, which is stored hashed
+// and only ever returned in plaintext when the client is registered. Public clients,
+// such as single-page and mobile apps, have no secret and must use PKCE instead.
+type OAuthClient struct {
+	ID           string    `json:"client_id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UserID       int64     `json:"-"`
+	Name         string    `json:"name"`
+	Secret       string    `json:"client_secret,omitempty"`
+	SecretHash   []byte    `json:"-"`
+	Confidential bool      `json:"confidential"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+}
+
+// HasRedirectURI reports whether uri is one of the client's registered redirect URIs.
+// Redirect URIs must match exactly.
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if uri == registered {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesSecret reports whether secret is the client's secret. It always returns false
+// for public clients.
+func (c *OAuthClient) MatchesSecret(secret string) bool {
+	if !c.Confidential {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+// AllowsScopes reports whether the client was registered with all of the given scopes.
+func (c *OAuthClient) AllowsScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !Permissions(c.Scopes).Include(scope) {
+			return false
+		}
+	}
+	return true
+}
+
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient, known Permissions) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(client.RedirectURIs) >= 1, "redirect_uris", "must contain at least 1 URI")
+	v.Check(len(client.RedirectURIs) <= 10, "redirect_uris", "must not contain more than 10 URIs")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+
+	for _, uri := range client.RedirectURIs {
+		v.Check(validRedirectURI(uri), "redirect_uris", "must only contain absolute https URIs, or http URIs on a loopback address")
+	}
+
+	v.Check(len(client.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+
+	for _, scope := range client.Scopes {
+		v.Check(known.Include(scope), "scopes", "must only contain known permission codes")
+	}
+}
+
+// The validRedirectURI() helper checks that the URI is absolute and has no fragment, as
+// required by RFC 6749. Plain http is only allowed for loopback addresses, which native
+// apps use to receive the redirect.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		if u.Hostname() == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(u.Hostname())
+		return ip != nil && ip.IsLoopback()
+	default:
+		return false
+	}
+}
+
+// The generateCredential() helper returns a random 26 character string, in the same
+// format as our tokens.
+func generateCredential() (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// Define the OAuthClientModel type.
+type OAuthClientModel struct {
+	DB DBTX
+}
+
+// Insert() generates a client ID, and a secret for confidential clients, and stores the
+// client. The plaintext secret is left in client.Secret for the caller to hand over.
+func (m OAuthClientModel) Insert(ctx context.Context, client *OAuthClient) error {
+	var err error
+
+	client.ID, err = generateCredential()
+	if err != nil {
+		return err
+	}
+
+	if client.Confidential {
+		client.Secret, err = generateCredential()
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.Sum256([]byte(client.Secret))
+		client.SecretHash = hash[:]
+	}
+
+	query := `
+	INSERT INTO oauth_clients (id, user_id, name, secret_hash, redirect_uris, scopes)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING created_at`
+
+	args := []interface{}{client.ID, client.UserID, client.Name, client.SecretHash, client.RedirectURIs, client.Scopes}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRow(ctx, query, args...).Scan(&client.CreatedAt)
+}
+
+// Get() returns the client with the given client ID.
+func (m OAuthClientModel) Get(ctx context.Context, id string) (*OAuthClient, error) {
+	query := `
+	SELECT id, created_at, user_id, name, secret_hash, redirect_uris, scopes
+	FROM oauth_clients
+	WHERE id = $1`
+
+	var client OAuthClient
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(
+		&client.ID,
+		&client.CreatedAt,
+		&client.UserID,
+		&client.Name,
+		&client.SecretHash,
+		&client.RedirectURIs,
+		&client.Scopes,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	client.Confidential = client.SecretHash != nil
+
+	return &client, nil
+}
+
+// GetAllForUser() returns the clients registered by a user.
+func (m OAuthClientModel) GetAllForUser(ctx context.Context, userID int64) ([]*OAuthClient, error) {
+	query := `
+	SELECT id, created_at, user_id, name, secret_hash, redirect_uris, scopes
+	FROM oauth_clients
+	WHERE user_id = $1
+	ORDER BY created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+
+	for rows.Next() {
+		var client OAuthClient
+
+		err := rows.Scan(
+			&client.ID,
+			&client.CreatedAt,
+			&client.UserID,
+			&client.Name,
+			&client.SecretHash,
+			&client.RedirectURIs,
+			&client.Scopes,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Confidential = client.SecretHash != nil
+
+		clients = append(clients, &client)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// Delete() removes a client registered by the given user. Any authorization codes and
+// access tokens issued to the client are deleted along with it.
+func (m OAuthClientModel) Delete(ctx context.Context, id string, userID int64) error {
+	query := `
+	DELETE FROM oauth_clients
+	WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Define an OAuthCode struct to hold an authorization code issued when a user approves
+// a client's authorization request. RedirectURI holds the redirect_uri exactly as it
+// was given in the authorization request (which may be empty), since the token request
+// must repeat it.
+type OAuthCode struct {
+	Plaintext     string
+	ClientID      string
+	UserID        int64
+	RedirectURI   string
+	Scopes        []string
+	CodeChallenge string
+	Expiry        time.Time
+}
+
+// Define the OAuthCodeModel type.
+type OAuthCodeModel struct {
+	DB DBTX
+}
+
+// Insert() generates the plaintext code and stores its hash.
+func (m OAuthCodeModel) Insert(ctx context.Context, code *OAuthCode) error {
+	var err error
+
+	code.Plaintext, err = generateCredential()
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256([]byte(code.Plaintext))
+
+	query := `
+	INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	args := []interface{}{hash[:], code.ClientID, code.UserID, code.RedirectURI, code.Scopes, code.CodeChallenge, code.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.Exec(ctx, query, args...)
+	return err
+}
+
+// Consume() deletes and returns the authorization code, so that each code can only be
+// exchanged once. It returns ErrRecordNotFound if the code is unknown or has expired.
+func (m OAuthCodeModel) Consume(ctx context.Context, plaintext string) (*OAuthCode, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+	DELETE FROM oauth_codes
+	WHERE hash = $1
+	RETURNING client_id, user_id, redirect_uri, scopes, code_challenge, expiry`
+
+	code := OAuthCode{Plaintext: plaintext}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, hash[:]).Scan(
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		&code.Scopes,
+		&code.CodeChallenge,
+		&code.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if time.Now().After(code.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &code, nil
+}
+
+// DeleteExpired() deletes up to batchSize authorization codes which expired without
+// being exchanged.
+func (m OAuthCodeModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	query := `
+	DELETE FROM oauth_codes
+	WHERE hash IN (
+		SELECT hash FROM oauth_codes
+		WHERE expiry < NOW()
+		LIMIT $1
+	)`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
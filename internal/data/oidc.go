@@ -0,0 +1,96 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Define an OIDCLogin struct to hold the values we need to remember between sending a
+// user to the identity provider and handling the callback. The state is stored hashed,
+// like tokens, and is only ever known in plaintext by the user's browser.
+type OIDCLogin struct {
+	State        string
+	CodeVerifier string
+	Nonce        string
+	Expiry       time.Time
+}
+
+// Define the OIDCLoginModel type.
+type OIDCLoginModel struct {
+	DB DBTX
+}
+
+// Insert() stores a pending OpenID Connect login.
+func (m OIDCLoginModel) Insert(ctx context.Context, login *OIDCLogin) error {
+	stateHash := sha256.Sum256([]byte(login.State))
+
+	query := `
+	INSERT INTO oidc_logins (state_hash, code_verifier, nonce, expiry)
+	VALUES ($1, $2, $3, $4)`
+
+	args := []interface{}{stateHash[:], login.CodeVerifier, login.Nonce, login.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, args...)
+	return err
+}
+
+// Consume() deletes and returns the pending login for the given state, so that each
+// state can only be used once. It returns ErrRecordNotFound if the state is unknown or
+// has expired.
+func (m OIDCLoginModel) Consume(ctx context.Context, state string) (*OIDCLogin, error) {
+	stateHash := sha256.Sum256([]byte(state))
+
+	query := `
+	DELETE FROM oidc_logins
+	WHERE state_hash = $1
+	RETURNING code_verifier, nonce, expiry`
+
+	login := OIDCLogin{State: state}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, stateHash[:]).Scan(&login.CodeVerifier, &login.Nonce, &login.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if time.Now().After(login.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &login, nil
+}
+
+// DeleteExpired() deletes up to batchSize abandoned logins which have expired.
+func (m OIDCLoginModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	query := `
+	DELETE FROM oidc_logins
+	WHERE state_hash IN (
+		SELECT state_hash FROM oidc_logins
+		WHERE expiry < NOW()
+		LIMIT $1
+	)`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
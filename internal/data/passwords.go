@@ -0,0 +1,139 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// Define an Argon2Params struct to hold the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follows the recommendations in RFC 9106 for memory-constrained
+// environments.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// PasswordParams holds the parameters used to hash new passwords. It is set from the
+// command-line flags at startup. Existing hashes made with other parameters, or with
+// bcrypt, keep verifying and are upgraded the next time the user logs in.
+var PasswordParams = DefaultArgon2Params
+
+// The hashPassword() helper returns an argon2id hash of the password, encoded in the
+// PHC string format so that the hash records the algorithm and parameters used, e.g.
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>.
+func hashPassword(plaintext string, params Argon2Params) ([]byte, error) {
+	salt := make([]byte, params.SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return []byte(hash), nil
+}
+
+// The decodeArgon2Hash() helper parses a PHC-formatted argon2id hash, returning the
+// parameters, salt and key.
+func decodeArgon2Hash(hash []byte) (*Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var params Argon2Params
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return nil, nil, nil, ErrInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidPasswordHash
+	}
+	params.SaltLength = uint32(len(salt))
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidPasswordHash
+	}
+	params.KeyLength = uint32(len(key))
+
+	return &params, salt, key, nil
+}
+
+// The isBcryptHash() helper reports whether the hash was made by bcrypt, which is what
+// we used before switching to argon2id.
+func isBcryptHash(hash []byte) bool {
+	return strings.HasPrefix(string(hash), "$2a$") || strings.HasPrefix(string(hash), "$2b$") || strings.HasPrefix(string(hash), "$2y$")
+}
+
+// The comparePassword() helper checks the plaintext password against a hash made by
+// either argon2id or bcrypt.
+func comparePassword(hash []byte, plaintext string) (bool, error) {
+	if isBcryptHash(hash) {
+		err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+		if err != nil {
+			switch {
+			case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	params, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+// The needsRehash() helper reports whether a hash was made with anything other than
+// argon2id and the current parameters.
+func needsRehash(hash []byte, current Argon2Params) bool {
+	params, _, _, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+
+	return *params != current
+}
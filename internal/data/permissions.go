@@ -4,7 +4,7 @@ import (
 	"context"
 	"time"
 
-	"github.com/jackc/pgx/v5/pgxpool"
+	"greenlight.mpdev.com/internal/validator"
 )
 
 // Define a Permissions slice, which we will use to will hold the permission codes (like "movies:read" and "movies:write") for a single user.
@@ -20,21 +20,48 @@ func (p Permissions) Include(code string) bool {
 	return false
 }
 
+// Intersect returns the permissions which are also in codes.
+func (p Permissions) Intersect(codes []string) Permissions {
+	permissions := Permissions{}
+	for _, code := range codes {
+		if p.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+	return permissions
+}
+
+func ValidatePermissionCodes(v *validator.Validator, codes []string, known Permissions) {
+	v.Check(len(codes) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(codes), "permissions", "must not contain duplicate values")
+
+	for _, code := range codes {
+		v.Check(known.Include(code), "permissions", "must only contain known permission codes")
+	}
+}
+
 // Define the PermissionModel type.
 type PermissionModel struct {
-	DB *pgxpool.Pool
+	DB DBTX
 }
 
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 
+	// Return the union of the permissions granted to the user directly and those
+	// granted through the roles assigned to them.
 	query := `
 	SELECT permissions.code
 	FROM permissions
 	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-	INNER JOIN users ON users_permissions.user_id = users.id
-	WHERE users.id = $1`
+	WHERE users_permissions.user_id = $1
+	UNION
+	SELECT permissions.code
+	FROM permissions
+	INNER JOIN role_permissions ON role_permissions.permission_id = permissions.id
+	INNER JOIN users_roles ON users_roles.role_id = role_permissions.role_id
+	WHERE users_roles.user_id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 	rows, err := m.DB.Query(ctx, query, userID)
 	if err != nil {
@@ -56,13 +83,57 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	query := `
 	INSERT INTO users_permissions
 	SELECT $1, permissions.id FROM permissions WHERE permissions.code =
-   ANY($2)`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+   ANY($2)
+	ON CONFLICT DO NOTHING`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 	_, err := m.DB.Exec(ctx, query, userID, codes)
 	return err
 }
+
+// RemoveForUser() revokes the given permission codes from a user.
+func (m PermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	query := `
+	DELETE FROM users_permissions
+	USING permissions
+	WHERE users_permissions.permission_id = permissions.id
+	AND users_permissions.user_id = $1
+	AND permissions.code = ANY($2)`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, userID, codes)
+	return err
+}
+
+// GetAll() returns every permission code known to the application.
+func (m PermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	query := `
+	SELECT code
+	FROM permissions
+	ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
@@ -0,0 +1,142 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"greenlight.mpdev.com/internal/validator"
+)
+
+// Define a Role struct to hold a named bundle of permissions.
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+func ValidateRoleNames(v *validator.Validator, names []string, known []*Role) {
+	v.Check(len(names) >= 1, "roles", "must contain at least 1 role")
+	v.Check(validator.Unique(names), "roles", "must not contain duplicate values")
+
+	knownNames := make([]string, len(known))
+	for i, role := range known {
+		knownNames[i] = role.Name
+	}
+
+	for _, name := range names {
+		v.Check(validator.In(name, knownNames...), "roles", "must only contain known role names")
+	}
+}
+
+// Define the RoleModel type.
+type RoleModel struct {
+	DB DBTX
+}
+
+// GetAll() returns every role along with the permission codes it grants.
+func (m RoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	query := `
+	SELECT roles.id, roles.name, COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+	FROM roles
+	LEFT JOIN role_permissions ON role_permissions.role_id = roles.id
+	LEFT JOIN permissions ON role_permissions.permission_id = permissions.id
+	GROUP BY roles.id
+	ORDER BY roles.id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(&role.ID, &role.Name, &role.Permissions)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// GetAllForUser() returns the names of the roles assigned to a user.
+func (m RoleModel) GetAllForUser(ctx context.Context, userID int64) ([]string, error) {
+	query := `
+	SELECT roles.name
+	FROM roles
+	INNER JOIN users_roles ON users_roles.role_id = roles.id
+	WHERE users_roles.user_id = $1
+	ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+
+	for rows.Next() {
+		var role string
+
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// AddForUser() assigns the named roles to a user. Roles the user already has are
+// ignored.
+func (m RoleModel) AddForUser(ctx context.Context, userID int64, names ...string) error {
+	query := `
+	INSERT INTO users_roles
+	SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+	ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID, names)
+	return err
+}
+
+// RemoveForUser() removes the named roles from a user.
+func (m RoleModel) RemoveForUser(ctx context.Context, userID int64, names ...string) error {
+	query := `
+	DELETE FROM users_roles
+	USING roles
+	WHERE users_roles.role_id = roles.id
+	AND users_roles.user_id = $1
+	AND roles.name = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID, names)
+	return err
+}
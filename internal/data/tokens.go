@@ -5,9 +5,10 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"errors"
 	"time"
 
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5"
 	"greenlight.mpdev.com/internal/validator"
 )
 
@@ -15,6 +16,10 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeTwoFactor      = "two-factor"
+	ScopeEmailChange    = "email-change"
+	ScopeOAuth          = "oauth"
+	ScopeLogin          = "login"
 )
 
 // Define a Token struct to hold the data for an individual token.
@@ -24,6 +29,8 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	ClientID  string    `json:"-"`
+	Scopes    []string  `json:"-"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token,
@@ -73,39 +80,108 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // Define the TokenModel type.
 type TokenModel struct {
-	DB *pgxpool.Pool
+	DB DBTX
 }
 
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+// NewForClient() issues an OAuth access token to a third-party client, acting on behalf
+// of the user and limited to the granted scopes.
+func (m TokenModel) NewForClient(ctx context.Context, userID int64, clientID string, scopes []string, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeOAuth)
+	if err != nil {
+		return nil, err
+	}
+	token.ClientID = clientID
+	token.Scopes = scopes
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
 // Insert() adds the data for a specific token to the tokens table.
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
-	INSERT INTO tokens (hash, user_id, expiry, scope) 
-	VALUES ($1, $2, $3, $4)`
+	INSERT INTO tokens (hash, user_id, expiry, scope, client_id, scopes) 
+	VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)`
 	args := []interface{}{token.Hash, token.UserID, token.Expiry,
-		token.Scope}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		token.Scope, token.ClientID, token.Scopes}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
 	defer cancel()
 	_, err := m.DB.Exec(ctx, query, args...)
 	return err
 }
 
+// Consume() deletes an unexpired token with the given scope and returns the ID of the
+// user it belonged to. Deleting and checking the token in one statement means that it
+// can only ever be used once, even by concurrent requests.
+func (m TokenModel) Consume(ctx context.Context, scope, tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	DELETE FROM tokens
+	WHERE hash = $1 AND scope = $2 AND expiry > $3
+	RETURNING user_id`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var userID int64
+	err := m.DB.QueryRow(ctx, query, tokenHash[:], scope, time.Now()).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return userID, nil
+}
+
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
 	DELETE FROM tokens 
 	WHERE scope = $1 AND user_id = $2`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 	_, err := m.DB.Exec(ctx, query, scope, userID)
 	return err
 }
+
+// DeleteAllScopesForUser() deletes every token belonging to a specific user.
+func (m TokenModel) DeleteAllScopesForUser(ctx context.Context, userID int64) error {
+	query := `
+	DELETE FROM tokens 
+	WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
+
+// DeleteExpired() deletes up to batchSize tokens which have expired, returning the
+// number deleted.
+func (m TokenModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	query := `
+	DELETE FROM tokens
+	WHERE hash IN (
+		SELECT hash FROM tokens
+		WHERE expiry < NOW()
+		LIMIT $1
+	)`
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	result, err := m.DB.Exec(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
@@ -0,0 +1,246 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"greenlight.mpdev.com/internal/validator"
+)
+
+// Number of one-time recovery codes handed out when two-factor authentication is enabled.
+const RecoveryCodeCount = 10
+
+// Define a TOTP struct to hold the two-factor authentication settings for a user.
+type TOTP struct {
+	UserID       int64     `json:"-"`
+	CreatedAt    time.Time `json:"-"`
+	Secret       string    `json:"secret"`
+	Enabled      bool      `json:"enabled"`
+	LastUsedStep int64     `json:"-"`
+}
+
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+// Define the TOTPModel type.
+type TOTPModel struct {
+	DB DBTX
+}
+
+// Get() returns the TOTP settings for a user, or ErrRecordNotFound if the user has
+// never started enrollment.
+func (m TOTPModel) Get(ctx context.Context, userID int64) (*TOTP, error) {
+	query := `
+	SELECT user_id, created_at, secret, enabled, last_used_step
+	FROM users_totp
+	WHERE user_id = $1`
+
+	var totp TOTP
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, userID).Scan(
+		&totp.UserID,
+		&totp.CreatedAt,
+		&totp.Secret,
+		&totp.Enabled,
+		&totp.LastUsedStep,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &totp, nil
+}
+
+// IsEnabled() reports whether the user has confirmed their TOTP enrollment.
+func (m TOTPModel) IsEnabled(ctx context.Context, userID int64) (bool, error) {
+	totp, err := m.Get(ctx, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return totp.Enabled, nil
+}
+
+// SetPending() stores a new, not yet confirmed, secret for the user. Any previous
+// unconfirmed secret is replaced.
+func (m TOTPModel) SetPending(ctx context.Context, userID int64, secret string) error {
+	query := `
+	INSERT INTO users_totp (user_id, secret)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET created_at = NOW(), secret = EXCLUDED.secret, enabled = false, last_used_step = 0`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID, secret)
+	return err
+}
+
+// Enable() marks the user's secret as confirmed.
+func (m TOTPModel) Enable(ctx context.Context, userID int64) error {
+	query := `
+	UPDATE users_totp
+	SET enabled = true
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// MarkUsed() records the time step of a code that was accepted. It fails with
+// ErrEditConflict if a code for the same (or a later) step was already used, which
+// stops a code from being replayed inside its validity window.
+func (m TOTPModel) MarkUsed(ctx context.Context, userID int64, step int64) error {
+	query := `
+	UPDATE users_totp
+	SET last_used_step = $2
+	WHERE user_id = $1 AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// Delete() removes the TOTP settings for a user, disabling two-factor authentication.
+func (m TOTPModel) Delete(ctx context.Context, userID int64) error {
+	query := `
+	DELETE FROM users_totp
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
+
+// Define the RecoveryCodeModel type.
+type RecoveryCodeModel struct {
+	DB DBTX
+}
+
+// New() replaces any existing recovery codes for the user with a fresh set and
+// returns their plaintext. Only the SHA-256 hashes are stored.
+func (m RecoveryCodeModel) New(ctx context.Context, userID int64) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([][]byte, RecoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 5)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		// Format the code as two groups of four characters, e.g. 7QKD-M2XA, which is
+		// easier for people to copy down.
+		code := base32.StdEncoding.EncodeToString(randomBytes)
+		codes[i] = code[:4] + "-" + code[4:]
+
+		hash := hashRecoveryCode(codes[i])
+		hashes[i] = hash[:]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `
+	INSERT INTO recovery_codes (hash, user_id)
+	SELECT unnest($1::bytea[]), $2`, hashes, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit(ctx)
+}
+
+// Consume() deletes the matching recovery code for the user, returning false if the
+// code is unknown or has already been used.
+func (m RecoveryCodeModel) Consume(ctx context.Context, userID int64, code string) (bool, error) {
+	hash := hashRecoveryCode(code)
+
+	query := `
+	DELETE FROM recovery_codes
+	WHERE hash = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, hash[:], userID)
+	if err != nil {
+		return false, err
+	}
+
+	return result.RowsAffected() == 1, nil
+}
+
+// DeleteAllForUser() deletes all recovery codes for a specific user.
+func (m RecoveryCodeModel) DeleteAllForUser(ctx context.Context, userID int64) error {
+	query := `
+	DELETE FROM recovery_codes
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID)
+	return err
+}
+
+// Recovery codes are compared case-insensitively and with or without the separator.
+func hashRecoveryCode(code string) [32]byte {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return sha256.Sum256([]byte(code))
+}
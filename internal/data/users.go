@@ -3,12 +3,14 @@ package data
 import (
 	"context"
 	"crypto/sha256"
-	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
-	"github.com/jackc/pgx/v5/pgxpool"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"greenlight.mpdev.com/internal/passwords"
 	"greenlight.mpdev.com/internal/validator"
 )
 
@@ -40,8 +42,9 @@ type password struct {
 	hash      []byte
 }
 
+// Set() hashes the password with argon2id using the current PasswordParams.
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := hashPassword(plaintextPassword, PasswordParams)
 	if err != nil {
 		return err
 	}
@@ -49,17 +52,18 @@ func (p *password) Set(plaintextPassword string) error {
 	p.hash = hash
 	return nil
 }
+
+// Matches() checks the plaintext password against the stored hash, which may be an
+// argon2id hash or a legacy bcrypt hash.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-	return true, nil
+	return comparePassword(p.hash, plaintextPassword)
+}
+
+// NeedsRehash() reports whether the stored hash is a bcrypt hash, or an argon2id hash
+// made with parameters other than the current PasswordParams. Call Set() with the
+// plaintext password after a successful login to upgrade it.
+func (p *password) NeedsRehash() bool {
+	return needsRehash(p.hash, PasswordParams)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -70,9 +74,40 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= 1000, "password", "must not be more than 1000 bytes long")
 
 }
+
+// MinPasswordEntropy is the minimum estimated entropy, in bits, of a new password.
+// That's roughly 9 random lowercase letters, or 7 mixing letters, digits and symbols.
+const MinPasswordEntropy = 40
+
+// ValidatePasswordStrength() checks that a new password isn't easy to guess. It is only
+// used when a password is set, so existing users with weaker passwords can still log in.
+func ValidatePasswordStrength(v *validator.Validator, password, name, email string) {
+	v.Check(!passwords.IsCommon(password), "password", "is too common, please choose another")
+	v.Check(!containsPersonalInfo(password, name, email), "password", "must not contain your name or email address")
+	v.Check(passwords.Entropy(password) >= MinPasswordEntropy, "password", "is too easy to guess, try making it longer or mixing in other kinds of characters")
+}
+
+// The containsPersonalInfo() helper reports whether the password contains any part of
+// the user's name, or the local part of their email address, ignoring case. Parts
+// shorter than 3 characters are ignored.
+func containsPersonalInfo(password, name, email string) bool {
+	password = strings.ToLower(password)
+
+	localPart, _, _ := strings.Cut(email, "@")
+	parts := append(strings.Fields(name), localPart)
+
+	for _, part := range parts {
+		part = strings.ToLower(part)
+		if len(part) >= 3 && strings.Contains(password, part) {
+			return true
+		}
+	}
+
+	return false
+}
 func ValidateUser(v *validator.Validator, user *User) {
 
 	v.Check(user.Name != "", "name", "must be provided")
@@ -83,6 +118,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 	if user.Password.plaintext != nil {
 		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidatePasswordStrength(v, *user.Password.plaintext, user.Name, user.Email)
 	}
 
 	if user.Password.hash == nil {
@@ -90,27 +126,35 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 }
 
+// The isDuplicateEmail() helper reports whether err is PostgreSQL rejecting a write
+// because it would violate the unique constraint on users.email. We check the SQLSTATE
+// code and constraint name rather than the message text, which depends on the driver.
+func isDuplicateEmail(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "users_email_key"
+}
+
 type UserModel struct {
-	DB *pgxpool.Pool
+	DB DBTX
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 
 	query := `
-	INSERT INTO users (name, email, password_hash, activated) 
-	VALUES ($1, $2, $3, $4)
+	INSERT INTO users (name, email, password_hash, activated, activated_at) 
+	VALUES ($1, $2, $3, $4, CASE WHEN $4 THEN NOW() END)
 	RETURNING id, created_at, version`
 
 	args := []interface{}{user.Name, user.Email, user.Password.hash,
 		user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case isDuplicateEmail(err):
 			return ErrDuplicateEmail
 		default:
 			return err
@@ -119,16 +163,109 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
 
 	query := `
 	SELECT id, created_at, name, email, password_hash, activated, version
 	FROM users
-	WHERE email = $1`
+	WHERE id = $1 AND deleted_at IS NULL`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// GetAll() returns a page of users whose name and email contain the given search
+// terms. Empty terms match every user.
+func (m UserModel) GetAll(ctx context.Context, name string, email string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, version
+	FROM users
+	WHERE (name ILIKE '%%' || $1 || '%%' OR $1 = '')
+	AND (email ILIKE '%%' || $2 || '%%' OR $2 = '')
+	AND deleted_at IS NULL
+	ORDER BY %s %s, id ASC
+	LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{name, email, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+
+	query := `
+	SELECT id, created_at, name, email, password_hash, activated, version
+	FROM users
+	WHERE email = $1 AND deleted_at IS NULL`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRow(ctx, query, email).Scan(
@@ -143,7 +280,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 	if err != nil {
 		switch {
-		case errors.Is(err, sql.ErrNoRows):
+		case errors.Is(err, pgx.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
 			return nil, err
@@ -153,11 +290,12 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 
 	query := `
 	UPDATE users 
 	SET name = $1, email = $2, password_hash = $3, activated = $4,
+   activated_at = CASE WHEN $4 THEN COALESCE(activated_at, NOW()) ELSE activated_at END,
    version = version + 1
 	WHERE id = $5 AND version = $6
 	RETURNING version`
@@ -171,16 +309,15 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRow(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique
-   constraint "users_email_key"`:
+		case isDuplicateEmail(err):
 			return ErrDuplicateEmail
-		case errors.Is(err, sql.ErrNoRows):
+		case errors.Is(err, pgx.ErrNoRows):
 			return ErrEditConflict
 		default:
 			return err
@@ -189,7 +326,101 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+// Delete() deactivates the user's account straight away. The record itself is only
+// removed by PurgeDeleted() once the grace period has passed.
+func (m UserModel) Delete(ctx context.Context, id int64) error {
+	query := `
+	UPDATE users
+	SET deleted_at = NOW(), version = version + 1
+	WHERE id = $1 AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// PurgeDeleted() permanently removes up to batchSize users deleted before the given
+// time. Their tokens, permissions and other dependent rows are removed by the ON DELETE
+// CASCADE foreign keys.
+func (m UserModel) PurgeDeleted(ctx context.Context, before time.Time, batchSize int) (int64, error) {
+	query := `
+	DELETE FROM users
+	WHERE id IN (
+		SELECT id FROM users
+		WHERE deleted_at < $1
+		LIMIT $2
+	)`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, before, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// WasActivated() reports whether the user has ever been activated, which tells an
+// account deactivated by an administrator apart from one which was never activated.
+func (m UserModel) WasActivated(ctx context.Context, id int64) (bool, error) {
+	query := `
+	SELECT activated_at IS NOT NULL
+	FROM users
+	WHERE id = $1`
+
+	var activated bool
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(&activated)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+
+	return activated, nil
+}
+
+// PurgeUnactivated() permanently removes up to batchSize accounts which signed up
+// before the given time and were never activated. Accounts which were activated and
+// later deactivated by an administrator are kept.
+func (m UserModel) PurgeUnactivated(ctx context.Context, before time.Time, batchSize int) (int64, error) {
+	query := `
+	DELETE FROM users
+	WHERE id IN (
+		SELECT id FROM users
+		WHERE activated_at IS NULL AND created_at < $1
+		LIMIT $2
+	)`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, before, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
+
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 
 	// Calculate the SHA-256 hash of the plaintext token provided
 	// Remember that this returns a byte *array* with length 32, not a slice.
@@ -204,13 +435,14 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 			ON users.id = tokens.user_id
 			WHERE tokens.hash = $1
 			AND tokens.scope = $2 
-			AND tokens.expiry > $3`
+			AND tokens.expiry > $3
+			AND users.deleted_at IS NULL`
 
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRow(ctx, query, args...).Scan(
@@ -224,7 +456,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	)
 	if err != nil {
 		switch {
-		case errors.Is(err, sql.ErrNoRows):
+		case errors.Is(err, pgx.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
 			return nil, err
@@ -234,3 +466,57 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	return &user, nil
 
 }
+
+// GetForAccessToken() returns the user for a token which grants access to the API,
+// which is either one of our own authentication tokens or an OAuth access token issued
+// to a third-party client. The token is returned as well so that the caller can tell
+// them apart and apply the scopes granted to the client.
+func (m UserModel) GetForAccessToken(ctx context.Context, tokenPlaintext string) (*User, *Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	SELECT users.id, users.created_at, users.name, users.email,
+	users.password_hash, users.activated, users.version,
+	tokens.expiry, tokens.scope, COALESCE(tokens.client_id, ''), tokens.scopes
+	FROM users
+	INNER JOIN tokens
+	ON users.id = tokens.user_id
+	WHERE tokens.hash = $1
+	AND tokens.scope = ANY($2)
+	AND tokens.expiry > $3
+	AND users.deleted_at IS NULL`
+
+	args := []interface{}{tokenHash[:], []string{ScopeAuthentication, ScopeOAuth}, time.Now()}
+
+	user := User{}
+	token := Token{Plaintext: tokenPlaintext, Hash: tokenHash[:]}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&token.Expiry,
+		&token.Scope,
+		&token.ClientID,
+		&token.Scopes,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	token.UserID = user.ID
+
+	return &user, &token, nil
+}
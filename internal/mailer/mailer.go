@@ -2,6 +2,7 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"embed"
 	"fmt"
@@ -9,11 +10,26 @@ import (
 	"time"
 
 	"github.com/go-mail/mail/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //go:embed "templates"
 var templateFS embed.FS
 
+var tracer = otel.Tracer("greenlight.mpdev.com/internal/mailer")
+
+var promSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "go_metrics",
+	Subsystem: "prometheus",
+	Name:      "mailer_sent_total",
+	Help:      "Emails sent, by template and result (success or failure).",
+}, []string{"template", "result"})
+
 type Mailer struct {
 	dialer *mail.Dialer
 	sender string
@@ -32,7 +48,21 @@ func New(host string, port int, username, password, sender string) Mailer {
 	}
 }
 
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
+// Send renders the template and sends it to the recipient, retrying a few times. The
+// attempt is traced as a child of the span in ctx, and counted by template and result.
+func (m Mailer) Send(ctx context.Context, recipient, templateFile string, data interface{}) (err error) {
+	_, span := tracer.Start(ctx, "mailer.Send", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("mail.template", templateFile)))
+	defer func() {
+		if err != nil {
+			promSent.WithLabelValues(templateFile, "failure").Inc()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			promSent.WithLabelValues(templateFile, "success").Inc()
+		}
+		span.End()
+	}()
 
 	tmpl, err := template.New("email").ParseFS(templateFS,
 		"templates/"+templateFile)
@@ -70,15 +100,13 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 	// error. We sleep for 500 milliseconds between each attempt.
 	for i := 1; i <= 3; i++ {
 		err = m.dialer.DialAndSend(msg)
-		fmt.Printf("msg: %v\n", err)
 		// If everything worked, return nil.
 		if nil == err {
-			fmt.Printf("email sent %s\n", m.sender)
 			return nil
 		}
 		// If it didn't work, sleep for a short time and retry.
 		time.Sleep(500 * time.Millisecond)
 	}
 
-	return nil
+	return fmt.Errorf("sending %s: %w", templateFile, err)
 }
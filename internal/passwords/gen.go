@@ -0,0 +1,48 @@
+//go:build ignore
+
+// This program builds common.bin from a list of common and breached passwords, one per
+// line. Each password is lowercased and hashed with SHA-256, and the first 8 bytes of
+// each hash are written out in sorted order so that IsCommon() can binary search them.
+// The bundled list is the password frequency list from zxcvbn (MIT licensed).
+//
+// Usage: go run gen.go < passwords.txt
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+func main() {
+	var hashes [][]byte
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		password := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if password == "" {
+			continue
+		}
+
+		hash := sha256.Sum256([]byte(password))
+		hashes = append(hashes, hash[:8])
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	slices.SortFunc(hashes, bytes.Compare)
+	hashes = slices.CompactFunc(hashes, bytes.Equal)
+
+	err := os.WriteFile("common.bin", bytes.Join(hashes, nil), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("wrote %d password hashes to common.bin", len(hashes))
+}
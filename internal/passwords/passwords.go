@@ -0,0 +1,116 @@
+// Package passwords estimates how easy a password is to guess.
+package passwords
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// commonHashes holds the sorted 8 byte SHA-256 prefixes of a list of common and
+// breached passwords, built by gen.go.
+//
+//go:embed common.bin
+var commonHashes []byte
+
+const hashPrefixSize = 8
+
+// IsCommon reports whether the password, ignoring case, is in the bundled list of
+// common passwords. Common passwords with digits or symbols tacked onto the end, like
+// "password123" or "monkey!", are treated as common too.
+func IsCommon(password string) bool {
+	password = strings.ToLower(password)
+
+	if contains(password) {
+		return true
+	}
+
+	trimmed := strings.TrimRightFunc(password, func(r rune) bool {
+		return unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+	})
+
+	return trimmed != password && len(trimmed) >= 4 && contains(trimmed)
+}
+
+func contains(password string) bool {
+	hash := sha256.Sum256([]byte(password))
+	prefix := hash[:hashPrefixSize]
+
+	n := len(commonHashes) / hashPrefixSize
+
+	i := sort.Search(n, func(i int) bool {
+		return bytes.Compare(commonHashes[i*hashPrefixSize:(i+1)*hashPrefixSize], prefix) >= 0
+	})
+
+	return i < n && bytes.Equal(commonHashes[i*hashPrefixSize:(i+1)*hashPrefixSize], prefix)
+}
+
+// Entropy returns a rough estimate, in bits, of how hard the password is to guess by
+// brute force. Each character contributes log2 of the size of the character classes
+// used in the password, except that characters which repeat the previous one or
+// continue a run like "abc" or "321" contribute nothing.
+func Entropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if symbol {
+		pool += 33
+	}
+	if other {
+		pool += 100
+	}
+
+	if pool == 0 {
+		return 0
+	}
+
+	length := 0
+	prev, step := rune(-1), rune(0)
+
+	for _, r := range password {
+		delta := r - prev
+
+		switch {
+		case delta == 0:
+			// A repeated character.
+		case (delta == 1 || delta == -1) && (step == 0 || step == delta):
+			// A character continuing a sequence.
+			step = delta
+		default:
+			step = 0
+			length++
+		}
+
+		prev = r
+	}
+
+	return float64(length) * math.Log2(float64(pool))
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How often the memory store looks for idle buckets to drop.
+const memoryCleanupInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // When the bucket will have refilled completely.
+}
+
+// MemoryStore keeps buckets in memory. The budget is per process, so it is only
+// suitable when a single API instance is running.
+type MemoryStore struct {
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:     make(map[string]*bucket),
+		lastCleanup: time.Now(),
+	}
+}
+
+func (s *MemoryStore) Allow(ctx context.Context, key string, rate float64, burst int) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	s.cleanup(now)
+
+	b, found := s.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(burst), updated: now}
+		s.buckets[key] = b
+	}
+
+	tokens, allowed := take(b.tokens, now.Sub(b.updated), rate, burst)
+
+	result := newResult(tokens, allowed, rate, burst)
+
+	b.tokens = tokens
+	b.updated = now
+	b.full = now.Add(result.Reset)
+
+	return result, nil
+}
+
+// The cleanup() method drops buckets which have refilled completely, since a missing
+// bucket is treated exactly like a full one. The caller must hold the mutex.
+func (s *MemoryStore) cleanup(now time.Time) {
+	if now.Sub(s.lastCleanup) < memoryCleanupInterval {
+		return
+	}
+
+	for key, b := range s.buckets {
+		if now.After(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+
+	s.lastCleanup = now
+}
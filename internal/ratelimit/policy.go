@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Define a Policy struct to hold one entry in the rate limit policy table. A request
+// is limited by the first policy which matches it, and each policy has its own
+// buckets. The empty value of each matching field matches every request.
+type Policy struct {
+	// Name identifies the policy, and keeps its buckets apart from those of other
+	// policies.
+	Name string `json:"name"`
+
+	// Route is a path pattern in the same form as our router uses, where a segment
+	// starting with ':' matches any single segment and a final segment starting with
+	// '*' matches the rest of the path, e.g. "/v1/movies/:id" or "/v1/admin/*path".
+	Route string `json:"route,omitempty"`
+
+	// Methods limits the policy to these HTTP methods.
+	Methods []string `json:"methods,omitempty"`
+
+	// Clients is "anonymous" to match only unauthenticated requests, or
+	// "authenticated" to match only authenticated ones.
+	Clients string `json:"clients,omitempty"`
+
+	// Permission matches authenticated users holding the permission, so that tiers of
+	// users, like partners, can be given their own limits.
+	Permission string `json:"permission,omitempty"`
+
+	// UserIDs matches these particular users.
+	UserIDs []int64 `json:"user_ids,omitempty"`
+
+	// RPS and Burst set the token bucket for each client: it holds up to Burst
+	// requests and refills at RPS requests per second.
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+}
+
+const (
+	ClientsAnonymous     = "anonymous"
+	ClientsAuthenticated = "authenticated"
+)
+
+// Define a Request struct to describe the request being limited to Policy.Matches().
+type Request struct {
+	Method string
+	Path   string
+
+	// UserID is 0 for anonymous requests.
+	UserID int64
+
+	// HasPermission reports whether the authenticated user holds the permission. It is
+	// only called for authenticated requests.
+	HasPermission func(code string) (bool, error)
+}
+
+// Matches reports whether the policy applies to the request.
+func (p *Policy) Matches(req Request) (bool, error) {
+	if p.Route != "" && !MatchRoute(p.Route, req.Path) {
+		return false, nil
+	}
+
+	if len(p.Methods) > 0 && !slices.Contains(p.Methods, req.Method) {
+		return false, nil
+	}
+
+	authenticated := req.UserID != 0
+
+	switch p.Clients {
+	case ClientsAnonymous:
+		if authenticated {
+			return false, nil
+		}
+	case ClientsAuthenticated:
+		if !authenticated {
+			return false, nil
+		}
+	}
+
+	if len(p.UserIDs) > 0 && !slices.Contains(p.UserIDs, req.UserID) {
+		return false, nil
+	}
+
+	if p.Permission != "" {
+		if !authenticated {
+			return false, nil
+		}
+		return req.HasPermission(p.Permission)
+	}
+
+	return true, nil
+}
+
+// Key returns the bucket key for the request under this policy. Authenticated users
+// get a bucket of their own wherever they connect from, and anonymous clients are
+// limited by IP address.
+func (p *Policy) Key(req Request, ip string) string {
+	if req.UserID != 0 {
+		return fmt.Sprintf("%s:user:%d", p.Name, req.UserID)
+	}
+	return fmt.Sprintf("%s:ip:%s", p.Name, ip)
+}
+
+// MatchRoute reports whether the path matches the route pattern. See Policy.Route.
+func MatchRoute(pattern, path string) bool {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, "*") && i == len(patternSegments)-1 {
+			return true
+		}
+
+		if i >= len(pathSegments) {
+			return false
+		}
+
+		if strings.HasPrefix(segment, ":") {
+			if pathSegments[i] == "" {
+				return false
+			}
+			continue
+		}
+
+		if segment != pathSegments[i] {
+			return false
+		}
+	}
+
+	return len(patternSegments) == len(pathSegments)
+}
+
+// LoadPolicies reads a JSON array of policies from the file, in the order they should
+// be tried.
+func LoadPolicies(path string) ([]Policy, error) {
+	js, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []Policy
+
+	err = json.Unmarshal(js, &policies)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+
+	for _, p := range policies {
+		switch {
+		case p.Name == "":
+			return nil, errors.New("every rate limit policy must have a name")
+		case names[p.Name]:
+			return nil, fmt.Errorf("duplicate rate limit policy %q", p.Name)
+		case p.RPS <= 0 || p.Burst < 1:
+			return nil, fmt.Errorf("rate limit policy %q must have a positive rps and a burst of at least 1", p.Name)
+		case p.Clients != "" && p.Clients != ClientsAnonymous && p.Clients != ClientsAuthenticated:
+			return nil, fmt.Errorf("rate limit policy %q has unknown clients %q", p.Name, p.Clients)
+		}
+
+		names[p.Name] = true
+	}
+
+	return policies, nil
+}
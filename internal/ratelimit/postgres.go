@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore keeps buckets in the rate_limit_buckets table, so that every API
+// instance using the same database shares one budget per key. Each call to Allow() is
+// a single atomic upsert, which refills the bucket, takes a token if there is one and
+// records whether it did, so concurrent requests can never overspend the bucket.
+type PostgresStore struct {
+	DB *pgxpool.Pool
+}
+
+func NewPostgresStore(db *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+func (s *PostgresStore) Allow(ctx context.Context, key string, rate float64, burst int) (Result, error) {
+	query := `
+	INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+	VALUES ($1, $3 - 1, true, NOW())
+	ON CONFLICT (key) DO UPDATE
+	SET tokens = CASE
+			WHEN LEAST($3, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at)::double precision * $2) >= 1
+			THEN LEAST($3, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at)::double precision * $2) - 1
+			ELSE LEAST($3, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at)::double precision * $2)
+		END,
+		allowed = LEAST($3, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at)::double precision * $2) >= 1,
+		updated_at = NOW()
+	RETURNING tokens, allowed`
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	var (
+		tokens  float64
+		allowed bool
+	)
+
+	err := s.DB.QueryRow(ctx, query, key, rate, float64(burst)).Scan(&tokens, &allowed)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return newResult(tokens, allowed, rate, burst), nil
+}
+
+// DeleteIdle() deletes up to batchSize buckets which haven't been used since before
+// the given time. Buckets are full again once they have been idle for burst/rate
+// seconds, and a missing bucket is treated as a full one, so as long as that time has
+// passed deleting them makes no difference to the limits.
+func (s *PostgresStore) DeleteIdle(ctx context.Context, before time.Time, batchSize int) (int64, error) {
+	query := `
+	DELETE FROM rate_limit_buckets
+	WHERE key IN (
+		SELECT key FROM rate_limit_buckets
+		WHERE updated_at < $1
+		LIMIT $2
+	)`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := s.DB.Exec(ctx, query, before, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected(), nil
+}
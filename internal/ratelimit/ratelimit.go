@@ -0,0 +1,64 @@
+// Package ratelimit implements token bucket rate limiting with pluggable storage for
+// the bucket state, so that several API instances can share one budget per client.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Store is implemented by each place we can keep token buckets. Allow() takes a token
+// from the bucket for key, creating it full if it doesn't exist yet. The bucket holds
+// up to burst tokens and refills at rate tokens per second.
+type Store interface {
+	Allow(ctx context.Context, key string, rate float64, burst int) (Result, error)
+}
+
+// Result describes the outcome of a call to Allow().
+type Result struct {
+	// Allowed reports whether a token was taken.
+	Allowed bool
+
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+
+	// RetryAfter is how long until the next token is available. It is zero when
+	// Allowed is true.
+	RetryAfter time.Duration
+
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// The take() helper refills a bucket which held tokens elapsed ago, then takes one
+// token from it if there is one. Both stores use it so that they behave the same.
+func take(tokens float64, elapsed time.Duration, rate float64, burst int) (float64, bool) {
+	tokens = math.Min(float64(burst), tokens+elapsed.Seconds()*rate)
+
+	if tokens < 1 {
+		return tokens, false
+	}
+
+	return tokens - 1, true
+}
+
+// The newResult() helper builds the Result for a bucket holding tokens after a call to
+// Allow().
+func newResult(tokens float64, allowed bool, rate float64, burst int) Result {
+	result := Result{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     seconds((float64(burst) - tokens) / rate),
+	}
+
+	if !allowed {
+		result.RetryAfter = seconds((1 - tokens) / rate)
+	}
+
+	return result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS users_totp (
+ user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+ created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+ secret text NOT NULL,
+ enabled bool NOT NULL DEFAULT false,
+ last_used_step bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+ hash bytea PRIMARY KEY,
+ user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE
+);
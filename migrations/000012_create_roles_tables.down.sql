@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS roles;
\ No newline at end of file
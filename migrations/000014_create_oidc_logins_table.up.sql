@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS oidc_logins (
+ state_hash bytea PRIMARY KEY,
+ code_verifier text NOT NULL,
+ nonce text NOT NULL,
+ expiry timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,6 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activated_at timestamp(0) with time zone;
+
+-- We don't know when existing users were activated, so use their sign-up time.
+UPDATE users SET activated_at = created_at WHERE activated AND activated_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS users_unactivated_idx ON users (created_at) WHERE activated_at IS NULL;
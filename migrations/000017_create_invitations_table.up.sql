@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS invitations (
+ id bigserial PRIMARY KEY,
+ created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+ hash bytea NOT NULL UNIQUE,
+ email citext NOT NULL,
+ permissions text[] NOT NULL,
+ invited_by bigint REFERENCES users ON DELETE SET NULL,
+ expiry timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,6 @@
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit_buckets (
+ key text PRIMARY KEY,
+ tokens double precision NOT NULL,
+ allowed boolean NOT NULL,
+ updated_at timestamp with time zone NOT NULL
+);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+ scope text NOT NULL,
+ key text NOT NULL,
+ fingerprint bytea NOT NULL,
+ status integer,
+ header jsonb,
+ body bytea,
+ expiry timestamp(0) with time zone NOT NULL,
+ PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expiry_idx ON idempotency_keys (expiry);